@@ -0,0 +1,246 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var cmdAdd = &Command{
+	UsageLine: "add [-link|-copy] [-force] <path>",
+	Short:     "add an existing file of the home directory to the dotfiles repo",
+	Long: `
+Add moves the given file of the home directory into the dotfiles repo. By default
+the file goes in the link dir and is replaced by a link to it. With -copy, the
+file goes in the copy dir and the original is kept as a copy. The path relative
+to the home directory is kept, eg. ~/.config/app/conf goes to link/.config/app/conf.
+
+If a file with the same path is already tracked, add asks before replacing it,
+unless -force is given.
+`,
+	Lock:    true,
+	Compile: true,
+}
+
+var (
+	addLink  = cmdAdd.Flag.Bool("link", false, "Move the file in the link dir and link it back (default).")
+	addCopy  = cmdAdd.Flag.Bool("copy", false, "Move the file in the copy dir and copy it back.")
+	addForce = cmdAdd.Flag.Bool("force", false, "Replace the tracked file with the same name without asking.")
+)
+
+func init() {
+	cmdAdd.Run = runAdd
+}
+
+// AlreadyTrackedError is returned when adding a file which has the same
+// name as a file already in the dotfiles repo
+type AlreadyTrackedError struct {
+	Path string
+}
+
+func (e *AlreadyTrackedError) Error() string {
+	return e.Path + " is already tracked"
+}
+
+func runAdd(cmd *Command, args []string) int {
+	if len(args) != 1 || (*addLink && *addCopy) {
+		cmd.Usage()
+		return exitUsage
+	}
+
+	dir := ln
+	if *addCopy {
+		dir = cp
+	}
+
+	if !repoExists() {
+		return exitFailure
+	}
+	loadCache()
+
+	err := addFile(dir, args[0], *addForce)
+	if tracked, ok := err.(*AlreadyTrackedError); ok {
+		rel, _ := filepath.Rel(BaseDir, tracked.Path)
+		if !console.confirm(rel + " is already tracked, replace it?") {
+			return exitFailure
+		}
+		err = addFile(dir, args[0], true)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// AddFile adopts the file at path into the given dotfiles dir. The file is
+// then linked or copied back to its original place.
+func addFile(dir Dir, path string, force bool) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(path); err != nil {
+		return err
+	}
+
+	if inRepo(path) {
+		return fmt.Errorf("%s is already in the dotfiles repo", path)
+	}
+
+	rel, err := filepath.Rel(RootDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("%s is not in %s", path, RootDir)
+	}
+
+	// Look for a file with the same path in the link and copy dirs
+	var replaced []Dir
+	for _, d := range [2]Dir{ln, cp} {
+		tracked := filepath.Join(BaseDir, d.String(), rel)
+		if _, err := os.Lstat(tracked); err != nil {
+			continue
+		}
+		if !force {
+			return &AlreadyTrackedError{tracked}
+		}
+		replaced = append(replaced, d)
+	}
+
+	// The replaced files and the original are kept aside until the link is
+	// done, so they are put back if something fails
+	var old aside
+	fail := func(err error) error {
+		if rerr := old.restore(); rerr != nil {
+			return fmt.Errorf("%v, then %v", err, rerr)
+		}
+		return err
+	}
+	for _, d := range replaced {
+		if err := old.move(filepath.Join(BaseDir, d.String(), rel)); err != nil {
+			return fail(err)
+		}
+	}
+
+	dest, err := cpToDot(dir, path)
+	if err != nil {
+		return fail(err)
+	}
+	if !old.contains(dest) {
+		old.created(dest)
+	}
+
+	if dir == ln {
+		if err := old.move(path); err != nil {
+			return fail(err)
+		}
+		if err := exec.Command("ln", "-s", dest, path).Run(); err != nil {
+			return fail(fmt.Errorf("failed to link %s: %v", path, err))
+		}
+	}
+	old.discard()
+
+	for _, d := range replaced {
+		cacheRemove(d.action(), filepath.Join(BaseDir, d.String(), rel))
+	}
+	cacheAdd(dir.action(), dest)
+
+	console.printArrow(shortPath(path) + " ➜ " + filepath.Join(dir.String(), rel))
+	return nil
+}
+
+// InRepo returns true if the path, once the links resolved, is in the
+// dotfiles repo
+func inRepo(path string) bool {
+	base, err := filepath.EvalSymlinks(BaseDir)
+	if err != nil {
+		return false
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return path == base || strings.HasPrefix(path, base+string(filepath.Separator))
+}
+
+// Aside keeps the files moved out of the way during a change, so they can be
+// put back if the change fails
+type aside struct {
+	// moved are the paths with where they are kept, or "" for the files
+	// created by the change
+	moved [][2]string
+}
+
+// Move moves the file at path to a temp dir next to it
+func (a *aside) move(path string) error {
+	dir, err := ioutil.TempDir(filepath.Dir(path), "."+filepath.Base(path)+".old")
+	if err != nil {
+		return err
+	}
+	saved := filepath.Join(dir, filepath.Base(path))
+	if err := os.Rename(path, saved); err != nil {
+		os.Remove(dir)
+		return err
+	}
+	a.moved = append(a.moved, [2]string{path, saved})
+	return nil
+}
+
+// Created records a file created by the change, it is removed on restore
+func (a *aside) created(path string) {
+	a.moved = append(a.moved, [2]string{path, ""})
+}
+
+func (a *aside) contains(path string) bool {
+	for _, m := range a.moved {
+		if m[0] == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Restore undoes the change in reverse order: the new files are removed and
+// the moved ones are put back. A file which can't be put back is left where
+// it is kept.
+func (a *aside) restore() error {
+	var kept []string
+	for i := len(a.moved) - 1; i >= 0; i-- {
+		path, saved := a.moved[i][0], a.moved[i][1]
+		os.RemoveAll(path)
+		if saved == "" {
+			continue
+		}
+		if err := os.Rename(saved, path); err != nil {
+			kept = append(kept, fmt.Sprintf("%s is kept in %s", path, saved))
+			continue
+		}
+		os.Remove(filepath.Dir(saved))
+	}
+	a.moved = nil
+
+	if len(kept) > 0 {
+		return fmt.Errorf("failed to restore the files: %s", strings.Join(kept, ", "))
+	}
+	return nil
+}
+
+// Discard removes the moved files once the change is done
+func (a *aside) discard() {
+	for _, m := range a.moved {
+		if m[1] != "" {
+			os.RemoveAll(filepath.Dir(m[1]))
+		}
+	}
+	a.moved = nil
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddLink(t *testing.T) {
+	initialize()
+
+	path := filepath.Join(RootDir, ".vimrc")
+	err := ioutil.WriteFile(path, []byte("set nu"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = addFile(ln, path, false)
+	if err != nil {
+		t.Fatalf("Failed to add %s: %v", path, err)
+	}
+
+	tracked := filepath.Join(BaseDir, "link", ".vimrc")
+	isPresent(t, BaseDir, filepath.Join("link", ".vimrc"))
+
+	target, err := os.Readlink(path)
+	if err != nil || target != tracked {
+		t.Errorf("%s should be linked to %s, but found %s (%v)", path, tracked, target, err)
+	}
+
+	if b, err := cacheContains(link, tracked); !b || err != nil {
+		t.Errorf("cache should contains %s", tracked)
+	}
+
+	err = addFile(ln, path, false)
+	if err == nil {
+		t.Errorf("a linked file should not be added twice")
+	}
+
+	cleanup()
+	invalideCache()
+}
+
+func TestAddAlreadyTracked(t *testing.T) {
+	initialize()
+
+	feedDir("link", 1)("old")
+
+	path := filepath.Join(RootDir, mockFileName(0))
+	err := ioutil.WriteFile(path, []byte("new"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = addFile(cp, path, false)
+	if _, ok := err.(*AlreadyTrackedError); !ok {
+		t.Fatalf("expected an AlreadyTrackedError but found %v", err)
+	}
+
+	err = addFile(cp, path, true)
+	if err != nil {
+		t.Fatalf("Failed to add %s: %v", path, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(BaseDir, "link", mockFileName(0))); !os.IsNotExist(err) {
+		t.Errorf("the file should have been removed from the link dir")
+	}
+
+	if err := checkDir("copy", 1)("new"); err != nil {
+		t.Error(err)
+	}
+
+	// A dir replaces the tracked file in the same dotfiles dir
+	os.Remove(path)
+	if err := os.Mkdir(path, 0777); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(path, "nested"), []byte("nested"), 0666)
+	if err := addFile(cp, path, true); err != nil {
+		t.Fatalf("Failed to add %s: %v", path, err)
+	}
+	tracked := filepath.Join(BaseDir, "copy", mockFileName(0))
+	if bytes, err := ioutil.ReadFile(filepath.Join(tracked, "nested")); err != nil || string(bytes) != "nested" {
+		t.Errorf("the dir should replace the tracked file, found %q (%v)", bytes, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(BaseDir, "copy", ".*")); len(files) != 0 {
+		t.Errorf("the temp files should have been removed, found %v", files)
+	}
+
+	cleanup()
+	invalideCache()
+}
+
+func TestAddRestoresOnFailure(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	feedDir("copy", 1)("old")
+	path := filepath.Join(RootDir, mockFileName(0))
+	if err := ioutil.WriteFile(path, []byte("new"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make ln fail
+	bin := filepath.Join(RootDir, "bin")
+	os.Mkdir(bin, 0777)
+	if err := ioutil.WriteFile(filepath.Join(bin, "ln"), []byte("#!/bin/sh\nexit 1\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	if err := addFile(ln, path, true); err == nil {
+		t.Fatal("the link should have failed")
+	}
+
+	if bytes, err := ioutil.ReadFile(path); err != nil || string(bytes) != "new" {
+		t.Errorf("the original file should have been put back, found %q (%v)", bytes, err)
+	}
+	if err := checkDir("copy", 1)("old"); err != nil {
+		t.Errorf("the tracked file should have been put back: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(BaseDir, "link", mockFileName(0))); !os.IsNotExist(err) {
+		t.Errorf("the new tracked file should have been removed")
+	}
+	for _, dir := range []string{RootDir, filepath.Join(BaseDir, "copy")} {
+		if files, _ := filepath.Glob(filepath.Join(dir, ".file0.old*")); len(files) != 0 {
+			t.Errorf("the temp files should have been removed, found %v", files)
+		}
+	}
+
+	cleanup()
+	invalideCache()
+}
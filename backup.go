@@ -0,0 +1,389 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Generation is a set of files backed up by the same run. Each generation
+// is stored in its own directory of the backup dir with a manifest.
+type Generation struct {
+	Time    time.Time
+	Entries []BackupEntry
+
+	// Dir is the directory of the generation
+	Dir string `json:"-"`
+
+	// Legacy is true for the files backed up in the backup dir itself by
+	// the previous versions of dotfiles
+	Legacy bool `json:"-"`
+}
+
+// BackupEntry is a file backed up in a generation
+type BackupEntry struct {
+	// Path is the original path of the file
+	Path string
+
+	// Backup is the path of the backup relative to the generation dir
+	Backup string
+
+	Mode   os.FileMode
+	Reason string
+
+	// Restored is set once the file has been put back in place
+	Restored time.Time `json:",omitempty"`
+}
+
+// BackupDir returns the directory containing the backup generations
+func backupDir() string {
+	return filepath.Join(StateDir, "backup")
+}
+
+// GenerationName matches the name of the dir of a generation
+var generationName = regexp.MustCompile(`^\d{8}-\d{6}(-\d+)?$`)
+
+// NewGeneration creates a new empty generation
+func newGeneration() (*Generation, error) {
+	now := time.Now()
+	name := now.Format("20060102-150405")
+
+	if err := os.MkdirAll(backupDir(), 0777); err != nil {
+		return nil, fmt.Errorf("failed to create backup dir: %v", err)
+	}
+
+	// Two runs in the same second get a suffix
+	dir := filepath.Join(backupDir(), name)
+	for i := 1; ; i++ {
+		err := os.Mkdir(dir, 0777)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create backup dir: %v", err)
+		}
+		dir = filepath.Join(backupDir(), name+"-"+strconv.Itoa(i))
+	}
+
+	g := &Generation{Time: now, Dir: dir}
+	return g, g.save()
+}
+
+// LoadGenerations returns all the generations, the oldest first. Without
+// the lock, the backups not migrated yet from the repo are read there.
+func loadGenerations() ([]*Generation, error) {
+	dirs := []string{backupDir()}
+	if !locked() {
+		dirs = append(dirs, legacyBackupDir())
+	}
+
+	var gens []*Generation
+	for _, dir := range dirs {
+		g, err := readGenerations(dir)
+		if err != nil {
+			return nil, err
+		}
+		gens = append(gens, g...)
+	}
+	sort.SliceStable(gens, func(i, j int) bool { return gens[i].Time.Before(gens[j].Time) })
+	return gens, nil
+}
+
+// ReadGenerations returns the generations of the backup dir
+func readGenerations(backups string) ([]*Generation, error) {
+	files, err := ioutil.ReadDir(backups)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var gens []*Generation
+	var legacy *Generation
+	for _, f := range files {
+		dir := filepath.Join(backups, f.Name())
+		bytes, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+		if err != nil && f.IsDir() && generationName.MatchString(f.Name()) {
+			// A generation whose manifest hasn't been written
+			continue
+		}
+
+		if err != nil {
+			// A file or a dir backed up by a previous version
+			if legacy == nil {
+				legacy = &Generation{Time: f.ModTime(), Dir: backups, Legacy: true}
+			}
+			legacy.Entries = append(legacy.Entries, BackupEntry{
+				Path:   filepath.Join(RootDir, f.Name()),
+				Backup: f.Name(),
+				Mode:   f.Mode(),
+				Reason: "legacy backup",
+			})
+			continue
+		}
+
+		var g Generation
+		if err := json.Unmarshal(bytes, &g); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal the manifest of %s: %v", dir, err)
+		}
+		g.Dir = dir
+		gens = append(gens, &g)
+	}
+
+	if legacy != nil {
+		gens = append([]*Generation{legacy}, gens...)
+	}
+	return gens, nil
+}
+
+// Save writes the manifest of the generation
+func (g *Generation) save() error {
+	if g.Legacy {
+		return nil
+	}
+
+	bytes, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(g.Dir, "manifest.json"), bytes, 0666)
+}
+
+// Add moves the file at path into the generation and returns its backup path
+func (g *Generation) add(path, reason string) (string, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(RootDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is not in %s", path, RootDir)
+	}
+
+	backup := filepath.Join(g.Dir, rel)
+	if err := os.MkdirAll(filepath.Dir(backup), 0777); err != nil {
+		return "", fmt.Errorf("failed to create backup dir: %v", err)
+	}
+
+	if err := exec.Command("mv", path, backup).Run(); err != nil {
+		return "", fmt.Errorf("failed to backup %s: %v", path, err)
+	}
+
+	g.Entries = append(g.Entries, BackupEntry{Path: path, Backup: rel, Mode: fi.Mode(), Reason: reason})
+	return backup, g.save()
+}
+
+// Restorer puts back backed up files. The files in the way are backed up in
+// a single generation, created by the first one.
+type restorer struct {
+	gen *Generation
+}
+
+// Generation returns the generation of the files in the way
+func (r *restorer) generation() (*Generation, error) {
+	if r.gen == nil {
+		gen, err := newGeneration()
+		if err != nil {
+			return nil, err
+		}
+		r.gen = gen
+	}
+	return r.gen, nil
+}
+
+// Restore puts back the file i of the generation. If a managed link or copy
+// is in the way it is removed, any other file is backed up.
+func (r *restorer) restore(g *Generation, i int) error {
+	entry := &g.Entries[i]
+
+	if _, err := os.Lstat(entry.Path); err == nil {
+		source := managedSource(entry.Path)
+		if source != "" {
+			if err := os.RemoveAll(entry.Path); err != nil {
+				return err
+			}
+			cacheRemove(link, source)
+			cacheRemove(copy, source)
+		} else {
+			gen, err := r.generation()
+			if err != nil {
+				return err
+			}
+			if _, err := gen.add(entry.Path, "replaced by a restore"); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(entry.Path), 0777); err != nil {
+		return err
+	}
+	if err := exec.Command("mv", filepath.Join(g.Dir, entry.Backup), entry.Path).Run(); err != nil {
+		return fmt.Errorf("failed to restore %s: %v", entry.Path, err)
+	}
+
+	entry.Restored = time.Now()
+	return g.save()
+}
+
+// ManagedSource returns the linked or copied file whose target is path,
+// if path is still a link to it or an unchanged copy of it
+func managedSource(path string) string {
+	for _, f := range cacheFiles(link) {
+		if target(f) == path {
+			if dest, err := os.Readlink(path); err == nil && filepath.Clean(dest) == f {
+				return f
+			}
+		}
+	}
+	for _, f := range cacheFiles(copy) {
+		if target(f) == path && copyUnchanged(f) {
+			return f
+		}
+	}
+	return ""
+}
+
+var cmdBackups = &Command{
+	Run:       runBackups,
+	UsageLine: "backups [list]",
+	Short:     "list the backed up files",
+	Long: `
+Backups lists the generations of backed up files, the oldest first. Each time
+dotfiles replaces existing files, they are moved in a new generation of the
+backup dir, with a manifest recording their original path, mode and the reason
+of the backup. The generation number can be given to 'dotfiles restore'.
+
+The files and dirs backed up by the previous versions of dotfiles, directly in
+the backup dir, are listed in a first legacy generation.
+`,
+}
+
+func runBackups(cmd *Command, args []string) int {
+	if len(args) > 1 || (len(args) == 1 && args[0] != "list") {
+		cmd.Usage()
+		return exitUsage
+	}
+
+	if !repoExists() {
+		return exitFailure
+	}
+	loadCache()
+
+	gens, err := loadGenerations()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+		return exitFailure
+	}
+
+	if len(gens) == 0 {
+		fmt.Println("No backup")
+	}
+	for i, g := range gens {
+		console.printHeader(fmt.Sprintf("%d. %s", i+1, g.Time.Format("2006-01-02 15:04:05")))
+		for _, e := range g.Entries {
+			line := fmt.Sprintf("%-30s %s  %s", shortPath(e.Path), e.Mode, e.Reason)
+			if e.Restored.IsZero() {
+				console.printArrow(line)
+			} else {
+				console.printOK(line + " (restored)")
+			}
+		}
+	}
+	return exitOK
+}
+
+var cmdRestore = &Command{
+	UsageLine: "restore [-generation N] [file...]",
+	Short:     "put back the backed up files",
+	Long: `
+Restore puts back the files of a backup generation at their original place.
+By default the last generation is restored, use 'dotfiles backups' to list
+them. The files to restore can be filtered by name or path.
+
+A link or a copy made by dotfiles which is in the way is removed and forgotten
+by the cache, so it will be backed up again by the next apply. The other files
+in the way are backed up together in a new generation.
+`,
+	Lock: true,
+}
+
+var restoreGeneration = cmdRestore.Flag.Int("generation", 0, "The number of the generation to restore (default the last one).")
+
+func init() {
+	cmdRestore.Run = runRestore
+}
+
+func runRestore(cmd *Command, args []string) int {
+	if !repoExists() {
+		return exitFailure
+	}
+	loadCache()
+
+	gens, err := loadGenerations()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+		return exitFailure
+	}
+
+	n := *restoreGeneration
+	if n == 0 {
+		n = len(gens)
+	}
+	if n < 1 || n > len(gens) {
+		fmt.Fprintf(os.Stderr, "dotfiles: no backup generation %d\n", n)
+		return exitFailure
+	}
+	g := gens[n-1]
+
+	console.printHeader("Restore " + g.Time.Format("2006-01-02 15:04:05"))
+
+	code := exitOK
+	var r restorer
+	for i, e := range g.Entries {
+		if !e.Restored.IsZero() || !matchPath(e.Path, args) {
+			continue
+		}
+		if err := r.restore(g, i); err != nil {
+			console.printKO(fmt.Sprintf("%s: %v", shortPath(e.Path), err))
+			code = exitFailure
+			continue
+		}
+		console.printOK(shortPath(e.Path))
+	}
+	return code
+}
+
+// MatchPath returns true if path matches one of the given names, or if no
+// name is given
+func matchPath(path string, names []string) bool {
+	if len(names) == 0 {
+		return true
+	}
+
+	for _, name := range names {
+		abs, _ := filepath.Abs(name)
+		if name == filepath.Base(path) || name == shortPath(path) || abs == path {
+			return true
+		}
+	}
+	return false
+}
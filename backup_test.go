@@ -0,0 +1,138 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerations(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	path := filepath.Join(RootDir, ".zshrc")
+
+	// Back up two versions of the same file
+	for _, content := range []string{"first", "second"} {
+		err := ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gen, err := newGeneration()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := gen.add(path, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gens, err := loadGenerations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gens) != 2 {
+		t.Fatalf("expected 2 generations but found %d", len(gens))
+	}
+
+	e := gens[0].Entries[0]
+	if e.Path != path || e.Mode != 0600 || e.Reason != "test" {
+		t.Errorf("unexpected backup entry %+v", e)
+	}
+
+	// Restore the first one while a link made by dotfiles is in the way
+	feedDir("link", 1)("data")
+	source := filepath.Join(BaseDir, "link", mockFileName(0))
+	os.Rename(source, filepath.Join(BaseDir, "link", ".zshrc"))
+	source = filepath.Join(BaseDir, "link", ".zshrc")
+	os.Symlink(source, path)
+	cacheAdd(link, source)
+
+	var r restorer
+	if err := r.restore(gens[0], 0); err != nil {
+		t.Fatal(err)
+	}
+
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil || string(bytes) != "first" {
+		t.Errorf("expected the first version to be restored but found %q (%v)", bytes, err)
+	}
+	if b, _ := cacheContains(link, source); b {
+		t.Errorf("the link should have been removed from the cache")
+	}
+
+	gens, _ = loadGenerations()
+	if gens[0].Entries[0].Restored.IsZero() {
+		t.Errorf("the entry should be marked as restored")
+	}
+
+	cleanup()
+	invalideCache()
+}
+
+func TestRestoreInTheWay(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	gen, err := newGeneration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{".bashrc", ".profile"}
+	for _, name := range names {
+		path := filepath.Join(RootDir, name)
+		ioutil.WriteFile(path, []byte("backed up"), 0666)
+		if _, err := gen.add(path, "test"); err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(path, []byte("in the way"), 0666)
+	}
+
+	var r restorer
+	for i := range names {
+		if err := r.restore(gen, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gens, err := loadGenerations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gens) != 2 || len(gens[1].Entries) != 2 {
+		t.Errorf("the files in the way should be backed up in a single generation, found %d generations", len(gens))
+	}
+
+	cleanup()
+	invalideCache()
+}
+
+func TestLegacyBackups(t *testing.T) {
+	initialize()
+
+	os.MkdirAll(filepath.Join(backupDir(), ".vim", "colors"), 0777)
+	ioutil.WriteFile(filepath.Join(backupDir(), ".vimrc"), []byte("legacy"), 0666)
+
+	gens, err := loadGenerations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gens) != 1 || !gens[0].Legacy || len(gens[0].Entries) != 2 {
+		t.Fatalf("expected the file and the dir in a legacy generation, found %+v", gens)
+	}
+	if e := gens[0].Entries[0]; e.Path != filepath.Join(RootDir, ".vim") || !e.Mode.IsDir() {
+		t.Errorf("unexpected legacy entry %+v", e)
+	}
+
+	os.RemoveAll(backupDir())
+	cleanup()
+}
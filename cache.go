@@ -1,49 +1,164 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
+// Version of the cache format. The version 1 stored only lists of paths, the
+// version 2 was keyed by absolute paths, the version 3 named the deselected
+// init scripts InitSelected.
+const cacheVersion = 4
+
 // Cache represents the structure of cache data
 type Cache struct {
-	Link         []string
-	Copy         []string
-	InitSelected []string
-	InitRun      []string
+	Version        int
+	Link           map[string]Entry
+	Copy           map[string]Entry
+	InitDeselected map[string]Entry
+	InitRun        map[string]Entry
+
+	// CreatedDir are the parent dirs created for the links and the copies,
+	// they are removed with the last file they contain
+	CreatedDir map[string]Entry
+}
+
+// The entries are keyed by the path of the file relative to the dotfiles repo,
+// so the cache doesn't depend on where the repo is checked out.
+
+// Entry records the state of a file when its action has been done
+type Entry struct {
+	// SourceHash is the hash of the file in the dotfiles repo
+	SourceHash string `json:",omitempty"`
+
+	// DestHash is the hash of the file in the home directory
+	DestHash string `json:",omitempty"`
+
+	Mode os.FileMode `json:",omitempty"`
+	Time time.Time
+
+	// Commit is the commit of the dotfiles repo
+	Commit string `json:",omitempty"`
+
+	// Status is the exit status of an init script
+	Status int `json:",omitempty"`
+
+	// Succeeded is when an init script last succeeded, it is kept when a
+	// later run fails
+	Succeeded time.Time
+}
+
+// UnmarshalJSON reads the current format of the cache, or migrates the
+// previous versions
+func (c *Cache) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Version        int
+		Link           json.RawMessage
+		Copy           json.RawMessage
+		InitSelected   json.RawMessage
+		InitDeselected json.RawMessage
+		InitRun        json.RawMessage
+		CreatedDir     json.RawMessage
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw.InitDeselected) == 0 {
+		// Version 3 and before
+		raw.InitDeselected = raw.InitSelected
+	}
+
+	fields := []struct {
+		raw     json.RawMessage
+		entries *map[string]Entry
+	}{
+		{raw.Link, &c.Link},
+		{raw.Copy, &c.Copy},
+		{raw.InitDeselected, &c.InitDeselected},
+		{raw.InitRun, &c.InitRun},
+		{raw.CreatedDir, &c.CreatedDir},
+	}
+
+	for _, field := range fields {
+		*field.entries = nil
+		if len(field.raw) == 0 {
+			continue
+		}
+
+		if bytes.HasPrefix(bytes.TrimSpace(field.raw), []byte("[")) {
+			// Version 1: the state of the files is unknown
+			var paths []string
+			if err := json.Unmarshal(field.raw, &paths); err != nil {
+				return err
+			}
+			*field.entries = make(map[string]Entry)
+			for _, path := range paths {
+				(*field.entries)[cacheKey(path)] = Entry{}
+			}
+			continue
+		}
+
+		var entries map[string]Entry
+		if err := json.Unmarshal(field.raw, &entries); err != nil {
+			return err
+		}
+		*field.entries = make(map[string]Entry)
+		for path, entry := range entries {
+			(*field.entries)[cacheKey(path)] = entry
+		}
+	}
+
+	c.Version = cacheVersion
+	return nil
 }
 
 // Action is a type of action that can be cached
 type Action string
 
-// List of the actions cached
+// List of the actions cached. InitDeselected records the init scripts the
+// user deselected while they would have run, with their hash at the time.
 const (
-	link         Action = "link"
-	copy         Action = "copy"
-	initSelected Action = "initSelected"
-	initRun      Action = "initRun"
+	link           Action = "link"
+	copy           Action = "copy"
+	initDeselected Action = "initDeselected"
+	initRun        Action = "initRun"
+	createdDir     Action = "createdDir"
 )
 
 var (
-	cachePath = filepath.Join(BaseDir, "cache", "cache.json")
+	cachePath = filepath.Join(StateDir, "cache.json")
 	cache     Cache
+
+	// cacheChanged is true when the cache has changes not written yet
+	cacheChanged bool
 )
 
+// LoadCache reads the cache from the state dir. With the lock held, the state
+// left in the repo by the previous versions is moved there first, otherwise
+// the legacy cache is read in the repo if there is no cache in the state dir.
 func loadCache() {
-	if _, err := os.Stat(filepath.Join(BaseDir, "cache")); os.IsNotExist(err) {
-		err := os.Mkdir(filepath.Join(BaseDir, "cache"), 0777)
-		if err != nil {
-			log.Fatal("Failed to create cache dir: ", err)
+	path := cachePath
+	if locked() {
+		if err := migrateState(); err != nil {
+			log.Fatalf("Unable to migrate the state of the repo:\n%s", err)
 		}
+	} else if _, err := os.Stat(cachePath); os.IsNotExist(err) {
+		path = legacyCachePath()
 	}
 
-	if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
 		// Cache exists, load it
-		bytes, err := ioutil.ReadFile(cachePath)
+		bytes, err := ioutil.ReadFile(path)
 		if err != nil {
 			log.Fatalf("Unable to load the cache:\n%s", err)
 		}
@@ -56,49 +171,98 @@ func loadCache() {
 	}
 }
 
+// CacheEntries returns the entries of the given action
+func cacheEntries(action Action) (*map[string]Entry, error) {
+	switch action {
+	case link:
+		return &cache.Link, nil
+	case copy:
+		return &cache.Copy, nil
+	case initDeselected:
+		return &cache.InitDeselected, nil
+	case initRun:
+		return &cache.InitRun, nil
+	case createdDir:
+		return &cache.CreatedDir, nil
+	}
+	return nil, fmt.Errorf("%s is not part of the possible cached actions", action)
+}
+
+// CacheAdd records that the action has been done on the file, with the
+// current state of the file. An existing entry is updated.
 func cacheAdd(action Action, file string) error {
 	if file == "" {
 		return fmt.Errorf("The path to the cache file cannot be \"\"")
 	}
 
-	switch action {
-	case link:
-		cache.Link = append(cache.Link, file)
-	case copy:
-		cache.Copy = append(cache.Copy, file)
-	case initSelected:
-		cache.InitSelected = append(cache.InitSelected, file)
-	case initRun:
-		cache.InitRun = append(cache.InitRun, file)
-	default:
-		return fmt.Errorf("%s is not part of the possible cached actions", action)
+	entries, err := cacheEntries(action)
+	if err != nil {
+		return err
+	}
+
+	entry := Entry{SourceHash: hashFile(file), Time: time.Now(), Commit: repoCommit()}
+	if fi, err := os.Lstat(file); err == nil {
+		entry.Mode = fi.Mode()
+	}
+	if action == link || action == copy {
+		entry.DestHash = hashFile(target(file))
 	}
 
-	flushCache()
+	if *entries == nil {
+		*entries = make(map[string]Entry)
+	}
+	(*entries)[cacheKey(file)] = entry
+
+	cacheChanged = true
+
+	return nil
+}
+
+// CacheRun records the run of the init script with its exit status
+func cacheRun(file string, status int) error {
+	last, _ := cacheGet(initRun, file)
+	if err := cacheAdd(initRun, file); err != nil {
+		return err
+	}
 
+	entry := cache.InitRun[cacheKey(file)]
+	entry.Status = status
+	entry.Succeeded = last.Succeeded
+	if status == 0 {
+		entry.Succeeded = entry.Time
+	}
+	cache.InitRun[cacheKey(file)] = entry
 	return nil
 }
 
+// Succeeded returns true if the init script succeeded once. The entries
+// written before the last success was recorded only know the last run.
+func (e Entry) succeeded() bool {
+	return !e.Succeeded.IsZero() || e.Status == 0
+}
+
+// CacheGet returns the entry of the file for the given action
+func cacheGet(action Action, file string) (Entry, bool) {
+	entries, err := cacheEntries(action)
+	if err != nil {
+		return Entry{}, false
+	}
+	entry, ok := (*entries)[cacheKey(file)]
+	return entry, ok
+}
+
 func cacheContains(action Action, file string) (bool, error) {
 	if file == "" {
 		return false, fmt.Errorf("The path to the cache file cannot be \"\"")
 	}
 
-	var res bool
-	switch action {
-	case link:
-		res = stringSlice(cache.Link).indexOf(file) != -1
-	case copy:
-		res = stringSlice(cache.Copy).indexOf(file) != -1
-	case initSelected:
-		res = stringSlice(cache.InitSelected).indexOf(file) != -1
-	case initRun:
-		res = stringSlice(cache.InitRun).indexOf(file) != -1
-	default:
-		return false, fmt.Errorf("%s is not part of the possible cached actions", action)
+	entries, err := cacheEntries(action)
+	if err != nil {
+		return false, err
 	}
 
-	return res, nil
+	_, ok := (*entries)[cacheKey(file)]
+	return ok, nil
 }
 
 func cacheRemove(action Action, file string) error {
@@ -106,58 +270,251 @@ func cacheRemove(action Action, file string) error {
 		return fmt.Errorf("The path to the cache file cannot be \"\"")
 	}
 
-	switch action {
-	case link:
-		cache.Link = stringSlice(cache.Link).remove(file)
-	case copy:
-		cache.Copy = stringSlice(cache.Copy).remove(file)
-	case initSelected:
-		cache.InitSelected = stringSlice(cache.InitSelected).remove(file)
-	case initRun:
-		cache.InitRun = stringSlice(cache.InitRun).remove(file)
-	default:
-		return fmt.Errorf("%s is not part of the possible cached actions", action)
+	entries, err := cacheEntries(action)
+	if err != nil {
+		return err
 	}
 
-	flushCache()
+	delete(*entries, cacheKey(file))
+
+	cacheChanged = true
 
 	return nil
 }
 
-// Write the cache on disk
-func flushCache() {
+// CacheFiles returns the sorted list of the files cached for the action
+func cacheFiles(action Action) []string {
+	entries, err := cacheEntries(action)
+	if err != nil {
+		return nil
+	}
+
+	var files []string
+	for key := range *entries {
+		files = append(files, cacheFile(key))
+	}
+	sort.Strings(files)
+	return files
+}
+
+// CacheKey returns the key of the file in the cache: its path relative to
+// the dotfiles repo if it is in the repo
+func cacheKey(file string) string {
+	if !filepath.IsAbs(file) {
+		return file
+	}
+	rel, err := filepath.Rel(BaseDir, file)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return file
+	}
+	return rel
+}
+
+// CacheFile returns the path of the file with the given key
+func cacheFile(key string) string {
+	if filepath.IsAbs(key) {
+		return key
+	}
+	return filepath.Join(BaseDir, key)
+}
+
+// FlushCache writes the cache on disk if it changed. The changes are batched
+// during a run and written at once, the file is replaced atomically so it is
+// never left half written.
+func flushCache() error {
+	if !cacheChanged {
+		return nil
+	}
+	cache.Version = cacheVersion
+
 	bytes, err := json.Marshal(&cache)
 	if err != nil {
 		log.Fatal("Unable to marshal the cache: ", err)
 	}
 
-	if _, err := os.Stat(filepath.Join(BaseDir, "cache")); os.IsNotExist(err) {
-		loadCache()
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0777); err != nil {
+		return fmt.Errorf("failed to create cache dir: %v", err)
 	}
 
-	err = ioutil.WriteFile(cachePath, bytes, 0666)
-	if err != nil {
-		log.Fatal("Unable to write the cache: ", err)
+	if err := writeFileAtomic(cachePath, bytes); err != nil {
+		return fmt.Errorf("unable to write the cache: %v", err)
 	}
+	cacheChanged = false
+	return nil
 }
 
 func invalideCache() error {
 	cache = Cache{}
+	cacheChanged = false
 	return os.Remove(cachePath)
 }
 
-type stringSlice []string
+// Commits of the dotfiles repos, by path
+var commits = make(map[string]string)
 
-func (slice stringSlice) indexOf(elem string) int {
-	for i, item := range slice {
-		if item == elem {
-			return i
+// RepoCommit returns the current commit of the dotfiles repo,
+// or "" if it is not a Git repo
+func repoCommit() string {
+	res, ok := commits[BaseDir]
+	if !ok {
+		out, err := exec.Command("git", "-C", BaseDir, "rev-parse", "HEAD").Output()
+		if err == nil {
+			res = strings.TrimSpace(string(out))
 		}
+		commits[BaseDir] = res
 	}
-	return -1
+	return res
+}
+
+// Actions lists the cached actions in the order they are shown
+var actions = []Action{link, copy, initDeselected, initRun, createdDir}
+
+var cmdCache = &Command{
+	UsageLine: "cache show [-json] | forget [-action name] [file...] | clear",
+	Short:     "inspect and edit the state recorded by dotfiles",
+	Long: `
+Cache shows and edits what dotfiles recorded about the files it copied or
+linked and the init scripts it ran.
+
+    show      print the cached entries, as JSON with -json
+    forget    remove the given files from the cache, eg. to run an init
+              script again or to copy a file again. With -action only the
+              entries of this action are forgotten, all of them if no file
+              is given. The actions are link, copy, initDeselected,
+              initRun and createdDir, the parent dirs created for the
+              files.
+    clear     remove all the entries
+
+The files can be given by path, by name, or by the path of their target in
+the home directory.
+`,
+	Lock: true,
+}
+
+func init() {
+	cmdCache.Run = runCache
 }
 
-func (slice stringSlice) remove(elem string) stringSlice {
-	index := slice.indexOf(elem)
-	return append(slice[:index], slice[index+1:]...)
+func runCache(cmd *Command, args []string) int {
+	if len(args) == 0 {
+		cmd.Usage()
+		return exitUsage
+	}
+
+	sub := flag.NewFlagSet("cache "+args[0], flag.ContinueOnError)
+	sub.Usage = cmd.Usage
+	showJSON := sub.Bool("json", false, "Print the cache as JSON.")
+	action := sub.String("action", "", "Only forget the entries of the given action.")
+	if err := sub.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+
+	if !repoExists() {
+		return exitFailure
+	}
+	loadCache()
+
+	switch args[0] {
+	case "show":
+		if sub.NArg() != 0 || *action != "" {
+			break
+		}
+		if *showJSON {
+			bytes, err := json.MarshalIndent(&cache, "", "  ")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+				return exitFailure
+			}
+			fmt.Println(string(bytes))
+			return exitOK
+		}
+		printCache()
+		return exitOK
+
+	case "forget":
+		if *showJSON || (sub.NArg() == 0 && *action == "") {
+			break
+		}
+		return forget(Action(*action), sub.Args())
+
+	case "clear":
+		if sub.NArg() != 0 || *showJSON || *action != "" {
+			break
+		}
+		if err := invalideCache(); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+			return exitFailure
+		}
+		console.printOK("Cache cleared")
+		return exitOK
+	}
+
+	cmd.Usage()
+	return exitUsage
+}
+
+func printCache() {
+	for _, action := range actions {
+		console.printHeader(string(action))
+		for _, f := range cacheFiles(action) {
+			entry, _ := cacheGet(action, f)
+
+			line := cacheKey(f)
+			if action == link || action == copy {
+				line += " ➜ " + shortPath(target(f))
+			}
+			if !entry.Time.IsZero() {
+				line += "  " + entry.Time.Format("2006-01-02 15:04:05")
+			}
+			if len(entry.Commit) >= 7 {
+				line += "  " + entry.Commit[:7]
+			}
+			console.printArrow(line)
+		}
+	}
+}
+
+// Forget removes the entries of the given files from the cache. If no action
+// is given the files are forgotten for all the actions, if no file is given
+// all the entries of the action are forgotten.
+func forget(action Action, names []string) int {
+	forgotten := actions
+	if action != "" {
+		if _, err := cacheEntries(action); err != nil {
+			fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+			return exitUsage
+		}
+		forgotten = []Action{action}
+	}
+
+	matched := make(map[string]bool)
+	for _, a := range forgotten {
+		for _, f := range cacheFiles(a) {
+			if len(names) > 0 && !matchCached(a, f, names) {
+				continue
+			}
+			cacheRemove(a, f)
+			matched[cacheKey(f)] = true
+			console.printArrow(fmt.Sprintf("%s (%s)", cacheKey(f), a))
+		}
+	}
+
+	if len(matched) == 0 {
+		fmt.Fprintf(os.Stderr, "dotfiles: no matching entry in the cache\n")
+		return exitFailure
+	}
+	return exitOK
+}
+
+// MatchCached returns true if the cached file is one of the given names
+func matchCached(action Action, file string, names []string) bool {
+	for _, name := range names {
+		if name == cacheKey(file) {
+			return true
+		}
+	}
+	if matchPath(file, names) {
+		return true
+	}
+	return (action == link || action == copy) && matchPath(target(file), names)
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -53,6 +56,9 @@ func TestLoadCache(t *testing.T) {
 		}
 	}
 
+	if err := flushCache(); err != nil {
+		t.Fatal(err)
+	}
 	cache = Cache{}
 
 	for _, file := range files {
@@ -73,6 +79,127 @@ func TestLoadCache(t *testing.T) {
 
 }
 
+func TestMigrateCache(t *testing.T) {
+	initialize()
+
+	v1 := `{"Link":["file1","file2"],"Copy":["file3"],"InitSelected":null,"InitRun":[]}`
+	os.MkdirAll(filepath.Dir(cachePath), 0777)
+	if err := ioutil.WriteFile(cachePath, []byte(v1), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	cache = Cache{}
+	loadCache()
+
+	for _, file := range []string{"file1", "file2"} {
+		if b, err := cacheContains(link, file); !b || err != nil {
+			t.Errorf("cache should contains %s", file)
+		}
+	}
+	if entry, ok := cacheGet(copy, "file3"); !ok || entry.DestHash != "" {
+		t.Errorf("cache should contains file3 without hash, but found %v", entry)
+	}
+	if cache.Version != cacheVersion {
+		t.Errorf("cache should be migrated to the version %d", cacheVersion)
+	}
+
+	// The version 3 named the deselected scripts InitSelected
+	v3 := `{"Version":3,"InitSelected":{"init/fonts.sh":{"SourceHash":"abc"}}}`
+	if err := ioutil.WriteFile(cachePath, []byte(v3), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cache = Cache{}
+	loadCache()
+	if entry, ok := cacheGet(initDeselected, "init/fonts.sh"); !ok || entry.SourceHash != "abc" {
+		t.Errorf("the deselected scripts should be migrated, found %v", cache.InitDeselected)
+	}
+
+	invalideCache()
+}
+
+func TestCacheHashes(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	feedDir("copy", 1)("data")
+	source := filepath.Join(BaseDir, "copy", mockFileName(0))
+	var dots Dotfiles
+	dots.read()
+	if err := testPlan(t, dots).apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, ok := cacheGet(copy, source)
+	if !ok {
+		t.Fatalf("cache should contains %s", source)
+	}
+	if entry.SourceHash == "" || entry.SourceHash != entry.DestHash {
+		t.Errorf("expected the same hash for the source and the copy, but found %v", entry)
+	}
+	if fileState(cp, source) != inSync {
+		t.Errorf("the copy should be in sync")
+	}
+
+	ioutil.WriteFile(source, []byte("changed"), 0666)
+	if st := fileState(cp, source); st != outdated {
+		t.Errorf("the copy should be outdated, but is %s", st)
+	}
+
+	ioutil.WriteFile(target(source), []byte("edited"), 0666)
+	if st := fileState(cp, source); st != modified {
+		t.Errorf("the copy should be modified, but is %s", st)
+	}
+
+	cleanup()
+	invalideCache()
+}
+
+func TestForget(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	script := filepath.Join(BaseDir, "init", "setup.sh")
+	linked := filepath.Join(BaseDir, "link", ".zshrc")
+	cacheAdd(initRun, script)
+	cacheAdd(initRun, filepath.Join(BaseDir, "init", "other.sh"))
+	cacheAdd(initDeselected, script)
+	cacheAdd(link, linked)
+
+	// By name, for all the actions
+	if code := forget("", []string{"setup.sh"}); code != exitOK {
+		t.Errorf("expected exit code %d but got %d", exitOK, code)
+	}
+	for _, action := range []Action{initRun, initDeselected} {
+		if b, _ := cacheContains(action, script); b {
+			t.Errorf("setup.sh should have been forgotten for %s", action)
+		}
+	}
+
+	// By target path
+	if code := forget(link, []string{filepath.Join(RootDir, ".zshrc")}); code != exitOK {
+		t.Errorf("expected exit code %d but got %d", exitOK, code)
+	}
+	if b, _ := cacheContains(link, linked); b {
+		t.Errorf(".zshrc should have been forgotten")
+	}
+
+	// All the entries of an action
+	forget(initRun, nil)
+	if len(cache.InitRun) != 0 {
+		t.Errorf("expected no initRun entry but found %v", cache.InitRun)
+	}
+
+	if code := forget("", []string{"unknown"}); code != exitFailure {
+		t.Errorf("expected exit code %d but got %d", exitFailure, code)
+	}
+	if code := forget("unknown", nil); code != exitUsage {
+		t.Errorf("expected exit code %d but got %d", exitUsage, code)
+	}
+
+	cleanup()
+	invalideCache()
+}
+
 func TestCacheErrorCases(t *testing.T) {
 	err := cacheAdd("", "file1")
 	if err == nil {
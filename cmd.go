@@ -19,6 +19,7 @@ import (
 	"os/user"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 var (
@@ -26,49 +27,6 @@ var (
 	quietMode = false
 )
 
-var help = `usage: dotfiles
-
-The dotfiles command provides few conventions to help you manage your dotfiles.
-If your dotfiles config is not setup the command will ask you if you want to
-clone an existing Git directory or creating a new config from scratch. The new
-config will look like this:
-
-    ~/.dotfiles
-      |_ bin
-      |_ conf
-      |_ copy
-      |_ init
-      |_ link
-      |_ test
-      |_ source
-      |_ vendor
-    
-## Copy
-
-All the files under the copy dir are copyed in the home directory. The first time,
-if the files already exist they will be backed up in the .dotfiles/backup directory.
-After if the files are different they will be copyied again.
-
-## Link
-
-Same thing as for the copy directory, but the files will be linked.
-
-## Init
-
-The command will prompt a menu to select the scripts to execute. If the scripts have
-been already run, they will be disable by default.
-
-## Source
-
-The files in the source directory should be sourced by the .zshrc (or .bashrc 
-depending on your favorite shell). This should not do more than that.
-
-## Shorcut
-
-The first time you can pass a Git URL to the dotfiles command to directly clone it
-without waiting the command to prompt the options.
-`
-
 // Default paths
 var (
 	// RootDir is the directory where files will be link or copy.
@@ -85,90 +43,469 @@ var (
 
 // flags
 var (
-	noCache = flag.Bool("nocache", false, "The script will be run like the first time.")
+	noCache  = flag.Bool("nocache", false, "The init scripts will be run like the first time, ignoring the cache.")
+	lockWait = flag.Duration("wait", 0, "Wait up to the given duration for another dotfiles process to finish, eg. -wait 1m.")
+
+	assumeYes      = flag.Bool("yes", false, "Never prompt: use the default choices and answer yes to the confirmations.")
+	nonInteractive = flag.Bool("non-interactive", false, "Never prompt: use the default choices and answer no to the confirmations.")
+	answersFile    = flag.String("answers", "", "Answer the first-run prompt with the given TOML file.")
+	initRunNames   = flag.String("run-init", "", "Run only the given init scripts, eg. -run-init brew,zsh.")
+	initSkipNames  = flag.String("skip-init", "", "Don't run the given init scripts.")
 )
 
 func changeRootDir(path string) {
 	RootDir = path
 	BaseDir = filepath.Join(RootDir, DotFilesDir)
-	cachePath = filepath.Join(BaseDir, "cache", "cache.json")
+	StateDir = defaultStateDir()
+	cachePath = filepath.Join(StateDir, "cache.json")
 }
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
 	usr, err := user.Current()
 	if err != nil {
-		fmt.Errorf("%v", err)
+		log.Fatal(err)
 	}
 	changeRootDir(usr.HomeDir)
 
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"apply"}
+	} else if isGitURL(args[0]) {
+		// Shortcut: clone the given repo before applying it
+		args = []string{"clone", "-apply", args[0]}
+	}
+
+	os.Exit(dispatch(args))
+}
+
+// IsGitURL returns true if the argument looks like a Git URL rather than a
+// command name
+func isGitURL(arg string) bool {
+	return strings.HasPrefix(arg, "git") ||
+		strings.HasPrefix(arg, "http") ||
+		strings.HasPrefix(arg, "ssh")
+}
+
+var cmdApply = &Command{
+	UsageLine: "apply [-dry-run] [-o plan.json] [-plan plan.json] [-jobs N] [-timeout d]",
+	Short:     "copy, link and run the init scripts of the dotfiles repo",
+	Long: `
+Apply installs the dotfiles repo in the home directory. If the repo is not
+setup yet, it asks whether to clone an existing Git repo or to create a new one.
+
+Apply never prompts when -yes or -non-interactive is given, or when the
+standard input is not a terminal, eg. in a Docker build or a CI job. The
+default selection of init scripts is then run, and the first-run question is
+answered by the TOML file given by -answers:
+
+    setup = "clone"    # clone, new or quit
+    url = "https://github.com/me/dotfiles.git"
+
+The -run-init flag replaces the default selection of init scripts by the
+given ones, eg. -run-init brew,zsh. The -skip-init flag removes the given
+scripts from the selection, eg. -skip-init fonts.
+
+Apply first builds a plan listing every action to do: the files to back up,
+copy and link, and the init scripts to run. With -dry-run the plan is printed
+instead of being applied, and with -o it is saved in a file. A saved plan can
+be reviewed and applied later on with -plan. It is rejected if a source file
+changed since the plan was made.
+
+The plan is applied as a transaction. If a step fails or if the command is
+interrupted, the files already backed up are restored, the new copies and
+links are removed and the cache is restored. If the command crashed, the next
+run rolls back the changes before doing anything else.
+
+Copy
+
+All the files under the copy dir are copyed in the home directory. The first time,
+if the files already exist they will be backed up in the state dir (see 'dotfiles
+help backups').
+After if the files are different they will be copyied again.
+
+Link
+
+Same thing as for the copy directory, but the files will be linked.
+
+Sub-directories
+
+The tree of the copy and link dirs is mirrored in the home directory, eg.
+link/.config/nvim/init.lua goes to ~/.config/nvim/init.lua and the missing
+parent directories are created. In the link dir, a directory is linked as a
+whole if it doesn't exist in the home directory yet, otherwise its files are
+linked one by one.
+
+State
+
+The cache, the backups and the journal are specific to each machine, they are
+kept out of the repo in $XDG_STATE_HOME/dotfiles/<repo-id> (~/.local/state by
+default). Set $DOTFILES_STATE_DIR to use another dir. The state left in the
+repo by the previous versions of dotfiles is moved there by the next command
+changing the state, eg. apply. The read-only commands like status read it in
+the repo until then.
+
+Init
+
+The command will prompt a menu to select the scripts to execute, showing the
+last run of each script: move with the arrow keys, toggle a script with space,
+all of them with a, filter them with / and confirm with enter. Esc keeps the
+default selection. On a dumb terminal, the ids of the scripts to toggle are
+asked instead. The scripts which are new, changed since their last run or
+which failed are selected by default, unless they have been deselected and
+didn't change since. The policy of a script can be changed by a comment at its
+top, a script with another policy is not run:
+
+    # run: onchange   run it again when it changes (default)
+    # run: once       run it until it succeeds once, even if it fails later
+    # run: always     run it every time
+
+The scripts are run in alphabetical order, except that a script runs after the
+scripts listed by its "# requires: zsh.sh, brew" comment. A script is skipped
+if one of the scripts it requires fails, or if they require each other.
+
+With -jobs N, up to N scripts are run in parallel, a script starting once the
+scripts it requires are done. Their output is not printed but logged in the
+logs dir of the state dir, the output of the failed scripts is printed at the
+end. The scripts run in parallel can't read the standard input.
+
+A failing script doesn't stop the others, but apply then exits with the
+status 1 so that a CI job or a Docker build can detect it. So does a script
+skipped because one of the scripts it requires failed.
+
+A script running longer than the -timeout duration (1h by default) is stopped
+and counts as failed. A script can set its own timeout with a "# timeout: 10m"
+comment, 0 meaning no limit. When dotfiles is interrupted, the signal is
+forwarded to the running scripts and they are proposed again by the next run.
+
+Each script is run from the dotfiles dir by the interpreter of its shebang, or
+else by the interpreter of its extension: bash for .sh and .bash, zsh for .zsh,
+fish for .fish and python3 for .py. The interpreters can be changed in
+conf/init.toml, eg.
+
+    [interpreters]
+    ".rb" = "ruby"
+
+A script without shebang nor known extension is run directly if it is
+executable, otherwise it is reported and skipped.
+
+A script can be restricted to some machines by a "# when:" comment listing
+conditions which must all hold, eg. "# when: os=linux, has=apt-get":
+
+    os=linux       the OS, as named by Go (linux, darwin, windows...)
+    host=build-*   the hostname matches the pattern
+    has=apt-get    the command is in the PATH
+    env=CI         the variable is set, env=CI=true for a given value
+
+A condition can list alternatives, eg. os=linux|freebsd. A script whose
+conditions don't hold is shown with the reason but can't be selected, it is
+never run nor recorded in the cache.
+
+Source
+
+The files in the source directory are sourced by the shells which load them
+with 'dotfiles shell-init' (see 'dotfiles help shell-init'). This should not
+do more than that.
+`,
+	Lock:    true,
+	Compile: true,
+}
+
+var (
+	applyDryRun  = cmdApply.Flag.Bool("dry-run", false, "Print the plan without applying it.")
+	applyOutput  = cmdApply.Flag.String("o", "", "Save the plan in the given file instead of applying it.")
+	applyPlan    = cmdApply.Flag.String("plan", "", "Apply the plan saved in the given file.")
+	applyJobs    = cmdApply.Flag.Int("jobs", 1, "Run up to N init scripts in parallel.")
+	applyTimeout = cmdApply.Flag.Duration("timeout", time.Hour, "Stop the init scripts running longer than this duration, 0 for no limit.")
+)
+
+func init() {
+	cmdApply.Run = runApply
+}
+
+func runApply(cmd *Command, args []string) int {
+	if len(args) != 0 || *applyJobs <= 0 || (*applyPlan != "" && (*applyDryRun || *applyOutput != "")) {
+		cmd.Usage()
+		return exitUsage
+	}
+
+	if *applyDryRun || *applyOutput != "" {
+		if !repoExists() {
+			return exitFailure
+		}
+		loadCache()
+
+		var dots Dotfiles
+		dots.read()
+		if _, _, err := initSelection(dots.Files[rn]); err != nil {
+			fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+			return exitFailure
+		}
+		plan, err := dots.plan(false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+			return exitFailure
+		}
+
+		if *applyOutput != "" {
+			if err := plan.save(*applyOutput); err != nil {
+				fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+				return exitFailure
+			}
+			return exitOK
+		}
+		plan.print()
+		return exitOK
+	}
+
 	console.printHeader("    .: Dotfiles :.")
-	arg0 := flag.Arg(0)
-	if arg0 != "" {
-		if arg0 == "help" {
-			fmt.Println(help)
-			os.Exit(1)
-		} else if strings.HasPrefix(arg0, "git") ||
-			strings.HasPrefix(arg0, "https") ||
-			strings.HasPrefix(arg0, "http") {
-
-			cloneRepo(arg0)
+
+	if *applyPlan != "" {
+		if !repoExists() {
+			return exitFailure
 		}
-	} else {
-		setup()
+		plan, err := loadPlan(*applyPlan)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+			return exitFailure
+		}
+
+		loadCache()
+		if err := recoverJournal(); err != nil {
+			fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+			return exitFailure
+		}
+		if err := plan.apply(); err != nil {
+			fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+			return exitFailure
+		}
+		if err := plan.failedScripts(); err != nil {
+			fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+			return exitFailure
+		}
+		console.printHeader("All done !")
+		return exitOK
 	}
 
-	run()
+	if !setup() {
+		return exitFailure
+	}
+
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+var cmdClone = &Command{
+	UsageLine: "clone [-apply] <git-url>",
+	Short:     "clone an existing dotfiles repo",
+	Long: `
+Clone clones the given Git repo into ~/.dotfiles.
+
+The first time you can pass a Git URL to the dotfiles command to directly clone it
+without waiting the command to prompt the options. This is the same as running
+'dotfiles clone -apply <git-url>'.
+`,
+	Lock:    true,
+	Compile: true,
 }
 
-func setup() {
+var cloneApply = cmdClone.Flag.Bool("apply", false, "Apply the dotfiles once cloned.")
+
+func init() {
+	cmdClone.Run = runClone
+}
+
+func runClone(cmd *Command, args []string) int {
+	if len(args) != 1 {
+		cmd.Usage()
+		return exitUsage
+	}
+
+	console.printHeader("    .: Dotfiles :.")
+	if err := cloneRepo(args[0]); err != nil {
+		return exitFailure
+	}
+
+	if *cloneApply {
+		if err := run(); err != nil {
+			fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+			return exitFailure
+		}
+	}
+	return exitOK
+}
+
+// RepoExists checks that the dotfiles repo exists and prints an error otherwise
+func repoExists() bool {
+	if _, err := os.Stat(BaseDir); err != nil {
+		fmt.Fprintf(os.Stderr, "dotfiles: %s is not setup yet, run 'dotfiles init' or 'dotfiles clone'\n", BaseDir)
+		return false
+	}
+	return true
+}
+
+// Setup checks that the dotfiles repo exists, or asks to create it.
+// It returns false if there is nothing to apply.
+func setup() bool {
 
 	_, err := os.Stat(BaseDir)
 	if err != nil && os.IsNotExist(err) {
 		// Not initialize yet
 
 		console.printHeader("Your .dotfiles repository is not setup yet.")
-		fmt.Printf("\nDo you want to (C)lone a dot repo, Create a (N)ew one, See the (H)elp or (Q)uit ? ")
 
-		var answer string
-		fmt.Scan(&answer)
+		var answer, url string
+		switch {
+		case *answersFile != "":
+			answer, url, err = loadAnswers(*answersFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+				return false
+			}
+		case !canPrompt():
+			fmt.Fprintf(os.Stderr, "dotfiles: no terminal to ask what to do, run 'dotfiles clone <git-url>', 'dotfiles init' or use -answers\n")
+			return false
+		default:
+			fmt.Printf("\nDo you want to (C)lone a dot repo, Create a (N)ew one, See the (H)elp or (Q)uit ? ")
+			fmt.Scan(&answer)
+		}
+
 		switch answer {
 		case "c", "C":
-			fmt.Printf("\nEnter a git URL: ")
-			var answer string
-			fmt.Scan(&answer)
-			cloneRepo(answer)
+			if url == "" {
+				fmt.Printf("\nEnter a git URL: ")
+				fmt.Scan(&url)
+			}
+			return cloneRepo(url) == nil
 		case "n", "N":
 			initialize()
-			os.Exit(1)
 		case "h", "H", "?":
-			fmt.Println(help)
-			os.Exit(1)
+			usage()
+			return false
 		case "q", "Q":
-			os.Exit(1)
+			return false
 		default:
-			fmt.Println(help)
-			os.Exit(1)
+			usage()
+			return false
 		}
 
 	}
+	return true
 }
 
-func run() {
+// LoadAnswers reads the answers to the first-run prompt from a TOML file:
+//
+//	setup = "clone"  # clone, new or quit
+//	url = "https://github.com/me/dotfiles.git"
+//
+// It returns the answer as typed at the prompt, and the URL to clone.
+func loadAnswers(path string) (answer, url string, err error) {
+	if _, err := os.Stat(path); err != nil {
+		return "", "", err
+	}
+	answers, err := loadTOML(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	setup, _ := answers.get("setup").(string)
+	url, _ = answers.get("url").(string)
+	switch setup {
+	case "clone":
+		if url == "" {
+			return "", "", fmt.Errorf("%s: the url to clone is missing", path)
+		}
+		return "c", url, nil
+	case "new":
+		return "n", "", nil
+	case "quit":
+		return "q", "", nil
+	}
+	return "", "", fmt.Errorf("%s: setup should be clone, new or quit, found %q", path, setup)
+}
+
+// InitSelection returns the init scripts given by -run-init and -skip-init.
+// It fails if one of them is not an init script.
+func initSelection(scripts []string) (run, skip map[string]bool, err error) {
+	run, err = matchScripts(scripts, *initRunNames)
+	if err != nil {
+		return nil, nil, fmt.Errorf("-run-init: %v", err)
+	}
+	skip, err = matchScripts(scripts, *initSkipNames)
+	if err != nil {
+		return nil, nil, fmt.Errorf("-skip-init: %v", err)
+	}
+	return run, skip, nil
+}
+
+// MatchScripts returns the scripts matching the names of the list
+func matchScripts(scripts []string, list string) (map[string]bool, error) {
+	matched := make(map[string]bool)
+	for _, name := range splitNames(list) {
+		found := false
+		for _, f := range scripts {
+			if matchScript(f, name) {
+				matched[f] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown init script %s", name)
+		}
+	}
+	return matched, nil
+}
+
+// SplitNames splits a list of names separated by commas or spaces
+func splitNames(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+func run() error {
 	loadCache()
+	if err := recoverJournal(); err != nil {
+		return err
+	}
 
 	var dots Dotfiles
 	dots.read()
-	dots.cp()
-	dots.ln()
-	dots.init()
+	if _, _, err := initSelection(dots.Files[rn]); err != nil {
+		return err
+	}
+	plan, err := dots.plan(canPrompt())
+	if err != nil {
+		return err
+	}
+	if err := plan.apply(); err != nil {
+		return err
+	}
+
+	orphans := 0
+	for _, r := range dots.planPrune() {
+		if r.Reason == "" {
+			orphans++
+		}
+	}
+	if orphans > 0 {
+		console.printHeader(fmt.Sprintf("%d files are no longer in the repo, run 'dotfiles prune' to remove them", orphans))
+	}
 
+	if err := plan.failedScripts(); err != nil {
+		return err
+	}
 	console.printHeader("All done !")
+	return nil
 }
 
 // CloneRepo clones the given git repository
-func cloneRepo(gitrepo string) {
+func cloneRepo(gitrepo string) error {
 	console.printHeader("Clone " + gitrepo)
 	git, err := exec.LookPath("git")
 	if err != nil {
@@ -185,17 +522,24 @@ func cloneRepo(gitrepo string) {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "# cd %s; %s\n", cmd.Dir, strings.Join(cmd.Args, " "))
 		os.Stderr.Write(out)
+		return err
 	}
 
-	// cmd.Stdout = bufio.NewWriter(os.Stdout)
-	// cmd.Stderr = bufio.NewWriter(os.Stderr)
-
-	// err = cmd.Run()
-	// if err != nil {
-	// 	log.Fatalf("Failed to clone %s: %s", gitrepo, err)
-	// }
-
 	console.printHeader(BaseDir + " is ready !")
+	return nil
+}
+
+// Target returns the path where the given dotfile is copied or linked.
+// The path relative to the link or copy dir is kept, eg. link/.config/app
+// goes to ~/.config/app.
+func target(file string) string {
+	for _, dir := range [2]Dir{ln, cp} {
+		rel, err := filepath.Rel(filepath.Join(BaseDir, dir.String()), file)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.Join(RootDir, rel)
+		}
+	}
+	return filepath.Join(RootDir, filepath.Base(file))
 }
 
 // BackgroundCheck verifies if there are some actions to do on the given file
@@ -205,10 +549,10 @@ func backgroundCheck(file string) bool {
 	source, err := os.Stat(file)
 	if err != nil && os.IsNotExist(err) {
 		// Can't background check a file which doesn't exists
-		fmt.Errorf("%s: no such file or directory", file)
+		return false
 	}
 
-	_, err = os.Stat(filepath.Join(RootDir, filepath.Base(file)))
+	_, err = os.Stat(target(file))
 	if err != nil && os.IsNotExist(err) {
 		// The destination file doesn't exist so go ahead
 		return true
@@ -225,78 +569,32 @@ func backgroundCheck(file string) bool {
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer sf.Close()
 
-	df, err := os.Open(filepath.Join(RootDir, filepath.Base(file)))
+	df, err := os.Open(target(file))
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer df.Close()
 
 	sscan := bufio.NewScanner(sf)
 	dscan := bufio.NewScanner(df)
 
 	for sscan.Scan() {
-		dscan.Scan()
-		if !bytes.Equal(sscan.Bytes(), dscan.Bytes()) {
+		if !dscan.Scan() || !bytes.Equal(sscan.Bytes(), dscan.Bytes()) {
 			return true
 		}
 	}
 
-	return false
-
+	// The destination file has more lines than the source
+	return dscan.Scan()
 }
 
-// BackupIfExist move a file in the backup dir if it exists
-func backupIfExist(file string) (string, string) {
-	file = filepath.Base(file)
-
-	// If there is no backup dir yet create it
-	if _, err := os.Stat(filepath.Join(BaseDir, "backup")); os.IsNotExist(err) {
-		err = os.Mkdir(filepath.Join(BaseDir, "backup"), 0777)
-		if err != nil {
-			log.Fatal("Failed to create backup dir: ", err)
-		}
-	}
-
-	path := filepath.Join(RootDir, file)
-
-	backupPath := filepath.Join(BaseDir, "backup", file)
-	if _, err := os.Stat(path); err == nil {
-		// The file already exists so backup it
-		err = exec.Command("mv", path, backupPath).Run()
-		if err != nil {
-			fmt.Errorf("Failed to backup %s\n%v", file, err)
-		}
-		return path, backupPath
+// ShortPath returns the path relative to the home directory, eg. ~/.zshrc
+func shortPath(path string) string {
+	rel, err := filepath.Rel(RootDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
 	}
-	return "", ""
+	return filepath.Join("~", rel)
 }
-
-// SourceDir source all the files in the source dir
-// Solution from here: http://stackoverflow.com/a/29995987/1292605
-
-// func sourceDir() {
-// 	applyCmd("source", func(file string) error {
-// 		printHeader("Sourcing " + file)
-
-// 		cmd := exec.Command("/bin/bash", "-c", "source "+file+" ; echo '<<<ENVIRONMENT>>>' ; env")
-// 		out, err := cmd.CombinedOutput()
-// 		if err != nil {
-// 			return err
-// 		}
-
-// 		s := bufio.NewScanner(bytes.NewReader(out))
-// 		start := false
-// 		for s.Scan() {
-// 			if s.Text() == "<<<ENVIRONMENT>>>" {
-// 				start = true
-// 			} else if start {
-// 				kv := strings.SplitN(s.Text(), "=", 2)
-// 				if len(kv) == 2 {
-// 					os.Setenv(kv[0], kv[1])
-// 				}
-// 			}
-// 		}
-
-// 		return nil
-// 	})
-// }
@@ -27,15 +27,15 @@ func TestMain(m *testing.M) {
 
 	tmpDir, err := ioutil.TempDir("", "go-test")
 	if err != nil {
-		fmt.Errorf("Failed to create tmp dir: %v", err)
+		log.Fatalf("Failed to create tmp dir: %v", err)
 	}
 
 	RootDir = filepath.Join(tmpDir, "root")
 	os.Mkdir(RootDir, 0777)
+	// Keep the state dirs of the tests in the tmp dir
+	os.Setenv("XDG_STATE_HOME", filepath.Join(tmpDir, "state"))
 	changeRootDir(RootDir)
 
-	cachePath = filepath.Join(BaseDir, "cache", "cache.json")
-
 	if debugMode {
 		fmt.Printf("BaseDir: %s\n", BaseDir)
 	}
@@ -43,6 +43,7 @@ func TestMain(m *testing.M) {
 	res := m.Run()
 
 	cleanup()
+	os.RemoveAll(filepath.Join(tmpDir, "state"))
 
 	os.Exit(res)
 }
@@ -55,7 +56,7 @@ func cleanup() {
 
 	tmpDir, err := ioutil.TempDir("", "go-test")
 	if err != nil {
-		fmt.Errorf("Failed to create tmp dir: %v", err)
+		log.Fatalf("Failed to create tmp dir: %v", err)
 	}
 
 	RootDir = filepath.Join(tmpDir, "root")
@@ -63,6 +64,24 @@ func cleanup() {
 	changeRootDir(RootDir)
 }
 
+// TestPlan returns the plan of the dotfiles without prompting
+func testPlan(t *testing.T, dots Dotfiles) *Plan {
+	plan, err := dots.plan(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+// TestInitSteps returns the steps of the init scripts without prompting
+func testInitSteps(t *testing.T, dots Dotfiles) []Step {
+	steps, err := dots.planInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return steps
+}
+
 func TestInitDotfilesDir(t *testing.T) {
 	initialize()
 
@@ -108,7 +127,9 @@ func TestBackgroundCheck(t *testing.T) {
 
 	dots.read()
 
-	dots.cp()
+	if err := testPlan(t, dots).apply(); err != nil {
+		t.Fatal(err)
+	}
 
 	if backgroundCheck(filepath.Join(BaseDir, "copy", "file0")) {
 		t.Errorf("Background check should be ko")
@@ -134,27 +155,19 @@ func TestBackupFile(t *testing.T) {
 		log.Fatal(err)
 	}
 
-	backupIfExist(file)
+	gen, err := newGeneration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen.add(filepath.Join(RootDir, file), "test")
 
-	if _, err := os.Stat(filepath.Join(BaseDir, "backup", file)); os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(gen.Dir, file)); os.IsNotExist(err) {
 		t.Errorf("Failed to backup %s", filepath.Join(RootDir, file))
 	}
 
 	cleanup()
 }
 
-// func TestSource(t *testing.T) {
-// 	initialize()
-
-// 	feedDir("source", 1)("echo plop; export FOO=\"youpi !!\"; env")
-
-// 	sourceDir()
-
-// 	if os.Getenv("FOO") != "youpi !!" {
-// 		t.Errorf("Failed to source files. Expected \"FOO=youpi !!\", but found \"%s\"", os.Getenv("FOO"))
-// 	}
-// }
-
 // ====== Utils ======
 
 func mockFileName(i int) string {
@@ -197,3 +210,88 @@ func isPresent(t *testing.T, base, name string) {
 		return
 	}
 }
+
+func TestLoadAnswers(t *testing.T) {
+	path := filepath.Join(RootDir, "answers.toml")
+	defer os.Remove(path)
+
+	tests := []struct {
+		content, answer, url string
+		ok                   bool
+	}{
+		{"setup = \"clone\"\nurl = \"https://example.com/dots.git\"", "c", "https://example.com/dots.git", true},
+		{"setup = \"new\"", "n", "", true},
+		{"setup = \"quit\"", "q", "", true},
+		{"setup = \"clone\"", "", "", false},
+		{"setup = \"help\"", "", "", false},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(path, []byte(test.content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		answer, url, err := loadAnswers(path)
+		if (err == nil) != test.ok || answer != test.answer || url != test.url {
+			t.Errorf("%q: expected %q %q, found %q %q (%v)", test.content, test.answer, test.url, answer, url, err)
+		}
+	}
+
+	if _, _, err := loadAnswers(filepath.Join(RootDir, "missing.toml")); err == nil {
+		t.Error("a missing answers file should be an error")
+	}
+}
+
+func TestInitSelection(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	writeScript(t, "brew.sh", "true", 0666)
+	writeScript(t, "fonts.sh", "true", 0666)
+	writeScript(t, "zsh.sh", "true", 0666)
+
+	// Both scripts are run once, then only when they change
+	var dots Dotfiles
+	dots.read()
+	if err := testPlan(t, dots).apply(); err != nil {
+		t.Fatal(err)
+	}
+	writeScript(t, "fonts.sh", "echo changed", 0666)
+	writeScript(t, "zsh.sh", "echo changed", 0666)
+
+	*initRunNames = "brew"
+	*initSkipNames = "fonts.sh"
+	defer func() { *initRunNames, *initSkipNames = "", "" }()
+
+	ops := make(map[string]Op)
+	for _, step := range testInitSteps(t, dots) {
+		ops[filepath.Base(step.Source)] = step.Op
+	}
+	if ops["brew.sh"] != opRun || ops["fonts.sh"] != opSkip {
+		t.Errorf("brew.sh should be run and fonts.sh skipped, found %v", ops)
+	}
+	// -run-init replaces the default selection
+	if ops["zsh.sh"] != opSkip {
+		t.Errorf("only the scripts given by -run-init should be run, found %v", ops)
+	}
+
+	*initSkipNames = "unknown"
+	if _, _, err := initSelection(dots.Files[rn]); err == nil {
+		t.Error("an unknown init script should be an error")
+	}
+
+	cleanup()
+}
+
+func TestConfirmWithoutPrompt(t *testing.T) {
+	*nonInteractive = true
+	defer func() { *nonInteractive = false }()
+
+	if console.confirm("Continue?") {
+		t.Error("the default answer should be no")
+	}
+
+	*assumeYes = true
+	defer func() { *assumeYes = false }()
+	if !console.confirm("Continue?") {
+		t.Error("the answer should be yes with -yes")
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Exit codes returned by the commands
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+
+	// exitDrift is returned when the home directory is not in sync
+	// with the dotfiles repo
+	exitDrift = 3
+)
+
+// Command is a dotfiles subcommand, eg. dotfiles apply
+type Command struct {
+	// Run runs the command. The args are the arguments left after
+	// the command flags. It returns the exit code of the command.
+	Run func(cmd *Command, args []string) int
+
+	// UsageLine is the one-line usage message.
+	// The first word in the line is taken to be the command name.
+	UsageLine string
+
+	// Short is the short description shown in the 'dotfiles help' output.
+	Short string
+
+	// Long is the long message shown in the 'dotfiles help <command>' output.
+	Long string
+
+	// Flag is the set of flags specific to this command.
+	Flag flag.FlagSet
+
+	// Lock is true if the command changes the state of the repo. Only one
+	// such command runs at once, and the cache is written when it ends.
+	Lock bool
+
+	// Compile is true if the command changes the files of the repo, the
+	// compiled shell loaders are updated when it ends. It requires Lock.
+	Compile bool
+}
+
+// Name returns the command's name: the first word in the usage line.
+func (c *Command) Name() string {
+	name := c.UsageLine
+	if i := strings.Index(name, " "); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// Usage prints the usage message of the command on stderr
+func (c *Command) Usage() {
+	fmt.Fprintf(os.Stderr, "usage: dotfiles %s\n", c.UsageLine)
+	c.Flag.SetOutput(os.Stderr)
+	c.Flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nRun 'dotfiles help %s' for details.\n", c.Name())
+}
+
+// Commands lists the available commands. The order here is the order
+// in which they are printed by 'dotfiles help'.
+var commands []*Command
+
+func init() {
+	cmdHelp.Run = runHelp
+
+	commands = []*Command{
+		cmdApply,
+		cmdClone,
+		cmdInit,
+		cmdAdd,
+		cmdStatus,
+		cmdDiff,
+		cmdBackups,
+		cmdRestore,
+		cmdUninstall,
+		cmdPrune,
+		cmdCache,
+		cmdLog,
+		cmdShellInit,
+		cmdHelp,
+	}
+}
+
+func lookupCommand(name string) *Command {
+	for _, cmd := range commands {
+		if cmd.Name() == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// Dispatch parses the command flags and runs the command named by args[0]
+func dispatch(args []string) int {
+	cmd := lookupCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "dotfiles: unknown command %q\nRun 'dotfiles help' for usage.\n", args[0])
+		return exitUsage
+	}
+
+	cmd.Flag.Usage = cmd.Usage
+	if err := cmd.Flag.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	if !cmd.Lock {
+		return cmd.Run(cmd, cmd.Flag.Args())
+	}
+
+	if err := lock(*lockWait); err != nil {
+		fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+		return exitFailure
+	}
+	defer unlock()
+
+	code := cmd.Run(cmd, cmd.Flag.Args())
+
+	// The files have been applied even if the shell config is invalid
+	if cmd.Compile {
+		if err := updateCompiledLoaders(); err != nil {
+			fmt.Fprintf(os.Stderr, "dotfiles: the compiled shell loaders are not updated: %v\n", err)
+		}
+	}
+
+	if err := flushCache(); err != nil {
+		fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+		return exitFailure
+	}
+	return code
+}
+
+// Usage prints the list of the commands and the global flags
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: dotfiles [flags] <command> [arguments]
+
+The dotfiles command provides few conventions to help you manage your dotfiles.
+
+The commands are:
+
+`)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "    %-11s %s\n", cmd.Name(), cmd.Short)
+	}
+	fmt.Fprintf(os.Stderr, `
+Without command, dotfiles runs apply. The first time, a Git URL can be given
+instead of a command to clone it before applying it.
+
+Use "dotfiles help <command>" for more information about a command.
+
+The flags are:
+
+`)
+	flag.CommandLine.SetOutput(os.Stderr)
+	flag.PrintDefaults()
+}
+
+var cmdHelp = &Command{
+	UsageLine: "help [command]",
+	Short:     "show the help of a command",
+	Long: `
+Help prints the list of the commands, or the documentation of the given command.
+`,
+}
+
+func runHelp(cmd *Command, args []string) int {
+	if len(args) == 0 {
+		usage()
+		return exitOK
+	}
+	if len(args) > 1 {
+		cmd.Usage()
+		return exitUsage
+	}
+
+	c := lookupCommand(args[0])
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "dotfiles: unknown help topic %q\nRun 'dotfiles help'.\n", args[0])
+		return exitUsage
+	}
+
+	fmt.Printf("usage: dotfiles %s\n", c.UsageLine)
+	fmt.Println(strings.TrimRight(c.Long, "\n"))
+
+	c.Flag.SetOutput(os.Stdout)
+	hasFlags := false
+	c.Flag.VisitAll(func(*flag.Flag) { hasFlags = true })
+	if hasFlags {
+		fmt.Println("\nThe flags are:")
+		fmt.Println()
+		c.Flag.PrintDefaults()
+	}
+	return exitOK
+}
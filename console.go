@@ -43,58 +43,114 @@ func (c Console) printKO(s string) {
 	c.print(fmt.Sprintf(" \033[1;31m✖\033[0m  %s\n", s))
 }
 
-func (c Console) printMenu(scripts []string, shouldBeRun map[string]bool) {
+// PrintMenu prints the init scripts in the order they will be run, with a
+// note for each one
+func (c Console) printMenu(scripts []string, shouldBeRun map[string]bool, notes map[string]string) {
 	console.printHeader("Run the following init scripts")
 
 	for i, script := range scripts {
+		line := strconv.Itoa(i) + ". " + filepath.Base(script)
+		if notes[script] != "" {
+			line += " (" + notes[script] + ")"
+		}
+
 		if shouldBeRun[script] {
-			c.printOK(strconv.Itoa(i) + ". " + filepath.Base(script))
+			c.printOK(line)
 		} else {
-			c.printKO(strconv.Itoa(i) + ". " + filepath.Base(script))
+			c.printKO(line)
 		}
 	}
 }
 
+// EditMenu is the text prompt editing the selection of the init scripts,
+// used when the terminal can't show the menu
 func (c Console) editMenu(scripts []string, shouldBeRun map[string]bool) map[string]bool {
 	fmt.Printf("\nEnter yes (y) to edit the list: ")
 	var input string
 	fmt.Scan(&input)
+	if input != "Y" && input != "y" {
+		return nil
+	}
 
-	var toggled []string
-	if input == "Y" || input == "y" {
-		reader := bufio.NewReader(os.Stdin)
-
+	reader := bufio.NewReader(os.Stdin)
+	for {
 		fmt.Printf("\nEnter the script ids to toggle: ")
 
 		text, err := reader.ReadString('\n')
-		if err != nil {
+		if err != nil && text == "" {
 			log.Fatal(err)
 		}
 
-		text = strings.TrimSuffix(text, "\n")
-
-		// check if ',' is used as separator
-		if strings.Contains(text, ",") {
-			toggled = strings.Split(text, ",")
-		} else {
-			toggled = strings.Split(text, " ")
+		ids, err := parseIDs(text, len(scripts))
+		if err != nil {
+			c.printKO(err.Error())
+			continue
 		}
-	} else {
-		return nil
+		for _, id := range ids {
+			shouldBeRun[scripts[id]] = !shouldBeRun[scripts[id]]
+		}
+		return shouldBeRun
 	}
+}
 
-	for _, script := range toggled {
-		id, err := strconv.Atoi(script)
+// ParseIDs parses the ids of the menu separated by commas or spaces
+func parseIDs(text string, count int) ([]int, error) {
+	var ids []int
+	for _, field := range splitNames(strings.TrimSpace(text)) {
+		id, err := strconv.Atoi(field)
 		if err != nil {
-			fmt.Printf("Expected script ids but found %s\n: %s", script, err)
+			return nil, fmt.Errorf("expected script ids but found %q", field)
 		}
-
-		for i, f := range scripts {
-			if i == id {
-				shouldBeRun[f] = !shouldBeRun[f]
-			}
+		if id < 0 || id >= count {
+			return nil, fmt.Errorf("no script with the id %d", id)
 		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// statusShown is true while a status line is printed
+var statusShown bool
 
+// PrintStatus replaces the status line at the bottom of the terminal. It is
+// not printed if the output is not a terminal.
+func (c Console) printStatus(s string) {
+	if quietMode || !isTerminal(os.Stdout) {
+		return
 	}
-	return shouldBeRun
+	fmt.Printf("\r\033[K\033[2m%s\033[0m", s)
+	statusShown = true
+}
+
+// ClearStatus removes the status line, before printing other lines
+func (c Console) clearStatus() {
+	if statusShown {
+		fmt.Printf("\r\033[K")
+		statusShown = false
+	}
+}
+
+// CanPrompt returns true if the user can be asked questions: -yes and
+// -non-interactive are not given and the standard input is a terminal
+func canPrompt() bool {
+	return !*assumeYes && !*nonInteractive && isTerminal(os.Stdin)
+}
+
+// Confirm asks a yes/no question, the default answer is no. Without prompt,
+// the answer is yes with -yes and no otherwise.
+func (c Console) confirm(question string) bool {
+	if !canPrompt() {
+		c.print(fmt.Sprintf("%s [y/N] ", question))
+		if *assumeYes {
+			c.print("yes\n")
+		} else {
+			c.print("no\n")
+		}
+		return *assumeYes
+	}
+
+	fmt.Printf("%s [y/N] ", question)
+	var answer string
+	fmt.Scanln(&answer)
+	return answer == "y" || answer == "Y" || answer == "yes"
 }
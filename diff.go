@@ -0,0 +1,282 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var cmdDiff = &Command{
+	UsageLine: "diff [-color=false] [file...]",
+	Short:     "show the changes between the dotfiles repo and the home directory",
+	Long: `
+Diff prints a unified diff for each copied file which differs from its copy in
+the home directory, and reports the linked files which don't point to the repo
+anymore. The files can be filtered by name, eg. 'dotfiles diff .zshrc'.
+
+Diff exits with 3 if there are differences.
+`,
+}
+
+var diffColor = cmdDiff.Flag.Bool("color", true, "Colorize the output.")
+
+func init() {
+	cmdDiff.Run = runDiff
+}
+
+func runDiff(cmd *Command, args []string) int {
+	if !repoExists() {
+		return exitFailure
+	}
+	loadCache()
+
+	var dots Dotfiles
+	dots.read()
+
+	code := exitOK
+	for _, st := range dots.status() {
+		if st.State == inSync || st.State == untracked || !matchFile(st, args) {
+			continue
+		}
+		if printDiff(os.Stdout, st, *diffColor) {
+			code = exitDrift
+		}
+	}
+	return code
+}
+
+// MatchFile returns true if the file status matches one of the given names,
+// or if no name is given
+func matchFile(st FileStatus, names []string) bool {
+	rel, _ := filepath.Rel(BaseDir, st.Source)
+	for _, name := range names {
+		if name == rel {
+			return true
+		}
+	}
+	return matchPath(st.Target, names)
+}
+
+// PrintDiff prints the difference between a dotfile and its target.
+// It returns true if something has been printed.
+func printDiff(w io.Writer, st FileStatus, color bool) bool {
+	rel := shortPath(st.Target)
+
+	if st.State == missing {
+		fmt.Fprintf(w, "%s: missing\n", rel)
+		return true
+	}
+
+	fi, err := os.Lstat(st.Target)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		dest, err := os.Readlink(st.Target)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if st.Dir == ln {
+			fmt.Fprintf(w, "%s: links to %s instead of %s\n", rel, dest, st.Source)
+		} else {
+			fmt.Fprintf(w, "%s: links to %s instead of being a copy of %s\n", rel, dest, st.Source)
+		}
+		return true
+	}
+
+	if !fi.Mode().IsRegular() {
+		fmt.Fprintf(w, "%s: is not a regular file\n", rel)
+		return true
+	}
+
+	a, err := ioutil.ReadFile(st.Source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(st.Target)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	unifiedDiff(w, shortPath(st.Source), rel, splitLines(string(a)), splitLines(string(b)), color)
+	return true
+}
+
+// SplitLines splits s after each new line. The lines keep their "\n"
+// so a missing new line at the end of the file is reported.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Edit is a line of the edit script between two files
+type edit struct {
+	op   byte // ' ', '-' or '+'
+	line string
+	a, b int // position in a and b before the edit
+}
+
+// DiffLines computes the shortest edit script from a to b
+// using the Myers' algorithm.
+func diffLines(a, b []string) []edit {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+
+	// trace[d] is the state of v at the beginning of the step d, only the
+	// diagonals -d-1 to d+1 which can be read by the step are kept
+	var trace [][]int
+
+loop:
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break loop
+			}
+		}
+	}
+
+	// Walk back the trace to build the edit script
+	var edits []edit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[d+k] < v[d+k+2]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[d+1+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, edit{' ', a[x], x, y})
+		}
+
+		if d > 0 {
+			if x == prevX {
+				edits = append(edits, edit{'+', b[prevY], prevX, prevY})
+			} else {
+				edits = append(edits, edit{'-', a[prevX], prevX, prevY})
+			}
+			x, y = prevX, prevY
+		}
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// Number of unchanged lines printed around the changes
+const diffContext = 3
+
+// UnifiedDiff writes the differences between a and b in the unified format
+func unifiedDiff(w io.Writer, fromName, toName string, a, b []string, color bool) {
+	paint := func(code, s string) string {
+		if !color {
+			return s
+		}
+		return "\033[" + code + "m" + s + "\033[0m"
+	}
+
+	edits := diffLines(a, b)
+
+	fmt.Fprintln(w, paint("1", "--- "+fromName))
+	fmt.Fprintln(w, paint("1", "+++ "+toName))
+
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+
+		// Extend the hunk while the next change is close enough
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(edits) && j <= end+2*diffContext; j++ {
+			if edits[j].op != ' ' {
+				end = j
+			}
+		}
+		stop := end + 1 + diffContext
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+
+		hunk := edits[start:stop]
+		var aLen, bLen int
+		for _, e := range hunk {
+			if e.op != '+' {
+				aLen++
+			}
+			if e.op != '-' {
+				bLen++
+			}
+		}
+		aStart, bStart := hunk[0].a, hunk[0].b
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+
+		fmt.Fprintln(w, paint("36", fmt.Sprintf("@@ -%d,%d +%d,%d @@", aStart, aLen, bStart, bLen)))
+		for _, e := range hunk {
+			line := string(e.op) + strings.TrimSuffix(e.line, "\n")
+			switch e.op {
+			case '-':
+				line = paint("31", line)
+			case '+':
+				line = paint("32", line)
+			}
+			fmt.Fprintln(w, line)
+			if !strings.HasSuffix(e.line, "\n") {
+				fmt.Fprintln(w, `\ No newline at end of file`)
+			}
+		}
+
+		i = stop
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\n"
+	b := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl"
+
+	expected := `--- from
++++ to
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -9,3 +9,4 @@
+ i
+ j
+ k
++l
+\ No newline at end of file
+`
+
+	var buf bytes.Buffer
+	unifiedDiff(&buf, "from", "to", splitLines(a), splitLines(b), false)
+
+	if buf.String() != expected {
+		t.Errorf("%s\n was expected but found\n%s", expected, buf.String())
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	cases := [][2]string{
+		{"", ""},
+		{"", "a\nb\n"},
+		{"a\nb\n", ""},
+		{"a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n"},
+	}
+
+	// Large files with many changes
+	var large [2]string
+	for i := 0; i < 2000; i++ {
+		large[0] += strconv.Itoa(i) + "\n"
+		if i%3 != 0 {
+			large[1] += strconv.Itoa(i) + "\n"
+		} else {
+			large[1] += "changed\n"
+		}
+	}
+	cases = append(cases, large)
+
+	for _, c := range cases {
+		a, b := splitLines(c[0]), splitLines(c[1])
+
+		// Applying the edit script on a should give b
+		var res []string
+		for _, e := range diffLines(a, b) {
+			if e.op != '-' {
+				res = append(res, e.line)
+			}
+		}
+		if strings.Join(res, "") != c[1] {
+			t.Errorf("%q was expected but found %q", c[1], strings.Join(res, ""))
+		}
+	}
+}
@@ -9,13 +9,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var console Console
@@ -42,11 +46,28 @@ func (d Dir) String() string {
 	return s
 }
 
+// Action returns the cached action corresponding to the dir
+func (d Dir) action() Action {
+	var a Action
+	switch d {
+	case ln:
+		a = link
+	case cp:
+		a = copy
+	case rn:
+		a = initRun
+	}
+	return a
+}
+
 // Dotfiles stores all the dot files by directory
 type Dotfiles struct {
 	Files map[Dir][]string
 }
 
+// Read lists the files of the dotfiles dirs. The files of the copy and
+// link dirs are read recursively: copy/.config/app/conf goes to
+// ~/.config/app/conf.
 func (dots *Dotfiles) read() {
 	dirs := [3]Dir{ln, cp, rn}
 
@@ -58,136 +79,331 @@ func (dots *Dotfiles) read() {
 
 		dirPath := filepath.Join(BaseDir, dir.String())
 
-		files, err := ioutil.ReadDir(dirPath)
+		var err error
+		if dir == rn {
+			err = dots.readDir(dir, dirPath, false)
+		} else {
+			err = dots.readDir(dir, dirPath, true)
+		}
 		if err != nil {
 			log.Fatalf("Failed to read %s dir: %s", dir, err)
 		}
+	}
 
-		for _, file := range files {
-			dots.Files[dir] = append(dots.Files[dir], filepath.Join(dirPath, file.Name()))
-		}
+}
+
+// ReadDir adds the files of dirPath. If recursive is true the sub-directories
+// are read too, except in the link dir where a sub-directory is linked as a
+// whole if its target is not an existing directory (like stow does).
+func (dots *Dotfiles) readDir(dir Dir, dirPath string, recursive bool) error {
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return err
 	}
 
+	for _, file := range files {
+		path := filepath.Join(dirPath, file.Name())
+
+		if !file.IsDir() || !recursive {
+			dots.Files[dir] = append(dots.Files[dir], path)
+			continue
+		}
+
+		if dir == ln {
+			fi, err := os.Lstat(target(path))
+			if err != nil || !fi.IsDir() {
+				// Fold the directory in a single link
+				dots.Files[dir] = append(dots.Files[dir], path)
+				continue
+			}
+		}
+
+		if err := dots.readDir(dir, path, recursive); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// BackupFiles backs up files which will be copyied or linked,
-// but which don't appear in the cache
-func (dots Dotfiles) backup(dir Dir, action Action) {
-	firstBackup := true
+// PlanBackup returns the steps to back up the files which will be copyied or
+// linked, but which don't appear in the cache or have been modified since
+// they were applied
+func (dots Dotfiles) planBackup(dir Dir, action Action) []Step {
+	var steps []Step
 
 	for _, f := range dots.Files[dir] {
 		contains, err := cacheContains(action, f)
 		if err != nil {
 			log.Fatal(err)
 		}
-		if !contains {
-			path, backupPath := backupIfExist(f)
-
-			// print feedback
-			if path != "" && backupPath != "" {
-				if firstBackup {
-					console.printHeader("Backup before " + dir.String() + "ing")
-					firstBackup = false
-				}
-
-				relPath, err := filepath.Rel(RootDir, backupPath)
-				if err != nil {
-					log.Fatal(err)
-				}
-				fmt.Printf(" %s ➜ %s\n", filepath.Base(path), relPath)
-			}
+		if _, err := os.Lstat(target(f)); err != nil {
+			continue
+		}
+
+		reason := ""
+		switch {
+		case !contains:
+			reason = "replaced by a " + dir.String() + " of " + shortPath(f)
+		case dir == cp && !copyUnchanged(f):
+			reason = "modified since it was copied"
+		case dir == ln && fileState(ln, f) == replaced:
+			reason = "replaced since it was linked"
+		}
+		if reason != "" {
+			steps = append(steps, Step{Op: opBackup, Source: target(f), Reason: reason})
 		}
 	}
+	return steps
+}
 
+// PlanInstall returns the steps to backup then copy or link the files of
+// the given dir
+func (dots Dotfiles) planInstall(dir Dir) []Step {
+	op := opLink
+	if dir == cp {
+		op = opCopy
+	}
+
+	steps := dots.planBackup(dir, dir.action())
+	backedUp := make(map[string]bool)
+	for _, step := range steps {
+		backedUp[step.Source] = true
+	}
+
+	for _, f := range dots.Files[dir] {
+		if backedUp[target(f)] || backgroundCheck(f) {
+			steps = append(steps, Step{Op: op, Source: f, Dest: target(f), Hash: hashFile(f)})
+		}
+	}
+	return steps
 }
 
-func (dots Dotfiles) cp() {
-	dots.backup(cp, copy)
+// Reason of the skip step of a script deselected by the user
+const deselected = "deselected"
 
-	console.printHeader("Copying files into home directory")
+// PlanInit returns the steps to run the init scripts. If interactive is true
+// the user can edit the default selection, an InterruptedError is returned
+// if the menu is interrupted.
+func (dots Dotfiles) planInit(interactive bool) ([]Step, error) {
+	// The scripts are run after the scripts they require
+	sorted, requires, invalid := sortScripts(dots.Files[rn])
 
-	for _, f := range dots.Files[cp] {
-		if backgroundCheck(f) {
+	// scripts to run
+	scripts := make(map[string]bool)
 
-			console.printArrow(filepath.Base(f))
+	// By default run the new, changed and failed scripts
+	reasons := make(map[string]string)
+	notes := make(map[string]string)
+	run, skip, _ := initSelection(sorted)
+	for _, f := range sorted {
+		reasons[f] = runReason(f)
+
+		// The selection given on the command line wins, -run-init replaces
+		// the default selection
+		switch {
+		case skip[f]:
+			reasons[f] = ""
+		case run[f]:
+			reasons[f] = "run-init"
+		case len(run) > 0:
+			reasons[f] = ""
+		}
+		scripts[f] = reasons[f] != "" && invalid[f] == ""
 
-			cacheAdd(copy, f)
+		var names []string
+		for _, req := range requires[f] {
+			names = append(names, filepath.Base(req))
+		}
+		switch {
+		case invalid[f] != "":
+			notes[f] = invalid[f]
+		case len(names) > 0 && reasons[f] != "":
+			notes[f] = reasons[f] + ", after " + strings.Join(names, ", ")
+		case len(names) > 0:
+			notes[f] = "after " + strings.Join(names, ", ")
+		default:
+			notes[f] = reasons[f]
+		}
+	}
 
-			err := exec.Command("cp", f, RootDir).Run()
-			if err != nil {
-				fmt.Errorf("Failed to copy %s", f)
+	if interactive && len(sorted) > 0 {
+		// Ask the user if he want to update the list
+		edited, err := console.selectMenu(sorted, scripts, notes, invalid)
+		switch err.(type) {
+		case nil:
+			scripts = edited
+			console.printMenu(sorted, scripts, notes)
+		case *InterruptedError:
+			// Nothing has been done yet
+			return nil, err
+		default:
+			// The terminal can't show the menu, use the text prompt
+			console.printMenu(sorted, scripts, notes)
+
+			edited := console.editMenu(sorted, scripts)
+			if edited != nil {
+				scripts = edited
+				console.printMenu(sorted, scripts, notes)
 			}
 		}
 	}
-}
 
-func (dots Dotfiles) ln() {
-	dots.backup(ln, link)
+	var steps []Step
+	for _, f := range sorted {
+		switch {
+		case invalid[f] != "":
+			steps = append(steps, Step{Op: opSkip, Source: f, Reason: invalid[f]})
+		case scripts[f]:
+			steps = append(steps, Step{Op: opRun, Source: f, Hash: hashFile(f), Requires: requires[f], Reason: reasons[f]})
+		case reasons[f] != "":
+			// It isn't proposed again until it changes
+			steps = append(steps, Step{Op: opSkip, Source: f, Reason: deselected})
+		default:
+			steps = append(steps, Step{Op: opSkip, Source: f})
+		}
+	}
+	return steps, nil
+}
 
-	console.printHeader("Linking files into home directory")
+// Run policies of the init scripts, set by a "# run:" header
+const (
+	// runOnChange runs the script again when it changes, it is the default
+	runOnChange = "onchange"
 
-	for _, f := range dots.Files[ln] {
-		if backgroundCheck(f) {
+	// runOnce runs the script until it succeeds once
+	runOnce = "once"
 
-			console.printArrow(f)
+	// runAlways runs the script every time
+	runAlways = "always"
+)
 
-			cacheAdd(link, f)
+// RunReason returns why the init script should be run by default: it is
+// new, it changed or it failed the last time. It returns "" if the script
+// should not be run, or if the user deselected it and it didn't change since.
+func runReason(f string) string {
+	if *noCache {
+		return "nocache"
+	}
 
-			err := exec.Command("ln", "-sf", f, RootDir).Run()
-			if err != nil {
-				fmt.Errorf("Failed to link %s", f)
-			}
-		}
+	script, err := parseScript(f)
+	if err != nil {
+		return ""
+	}
+	policy, err := script.policy()
+	if err != nil {
+		return ""
+	}
+	if policy == runAlways {
+		return "always"
 	}
-}
 
-func (dots Dotfiles) init() []byte {
-	// scripts to run
-	scripts := make(map[string]bool)
+	if entry, ok := cacheGet(initDeselected, f); ok && entry.SourceHash == hashFile(f) {
+		return ""
+	}
 
-	// By default run the script not cached
-	for _, f := range dots.Files[rn] {
-		contains, err := cacheContains(initRun, f)
-		if err != nil {
-			log.Fatal(err)
-		}
-		scripts[f] = !contains
+	entry, ran := cacheGet(initRun, f)
+	switch {
+	case !ran:
+		return "new"
+	case policy == runOnce && entry.succeeded():
+		return ""
+	case entry.Status != 0:
+		return "failed"
+	case policy == runOnChange && entry.SourceHash != "" && entry.SourceHash != hashFile(f):
+		return "changed"
 	}
+	return ""
+}
 
-	// Ask the user if he want to update the list
-	console.printMenu(dots.Files[rn], scripts)
+// Plan returns the steps to copy, link and run the dotfiles
+func (dots Dotfiles) plan(interactive bool) (*Plan, error) {
+	plan := newPlan()
+	plan.Steps = append(plan.Steps, dots.planInstall(cp)...)
+	plan.Steps = append(plan.Steps, dots.planInstall(ln)...)
+	steps, err := dots.planInit(interactive)
+	if err != nil {
+		return nil, err
+	}
+	plan.Steps = append(plan.Steps, steps...)
+	return plan, nil
+}
 
-	edited := console.editMenu(dots.Files[rn], scripts)
-	if edited != nil {
-		scripts = edited
-		console.printMenu(dots.Files[rn], scripts)
+// KillDelay is how long a script can take to exit once it is asked to stop,
+// before it is killed
+const killDelay = 5 * time.Second
+
+// RunScript runs the given init script from the dotfiles dir, with the
+// interpreter of its shebang or of its extension. The script runs in its own
+// process group: when the context is canceled by a signal the signal is
+// forwarded to the group, and when the script times out the group is
+// terminated.
+func runScript(ctx context.Context, f string, stdout, stderr io.Writer) error {
+	script, err := parseScript(f)
+	if err != nil {
+		return err
+	}
+	args, err := script.command()
+	if err != nil {
+		return err
+	}
+	timeout, err := script.timeout()
+	if err != nil {
+		return err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	var out []byte
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = BaseDir
+	setProcessGroup(cmd)
 
-	// run the selected scripts
-	for _, f := range dots.Files[rn] {
-		if scripts[f] {
-			console.printHeader("Run " + filepath.Base(f))
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
-			path := filepath.Join("init", filepath.Base(f))
-			cmd := exec.Command("/bin/bash", "-c", "source "+path)
-			cmd.Dir = BaseDir
+	done := make(chan error, 1)
+	if err = cmd.Start(); err == nil {
+		go func() { done <- cmd.Wait() }()
 
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			err = context.Cause(ctx)
+			if err == context.DeadlineExceeded {
+				err = &TimeoutError{timeout}
+			}
 
-			err := cmd.Run()
+			sig := os.Signal(syscall.SIGTERM)
+			if interrupted, ok := err.(*InterruptedError); ok {
+				sig = interrupted.Signal
+			}
+			signalProcessGroup(cmd, sig)
 
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "# cd %s; %s\n", cmd.Dir, strings.Join(cmd.Args, " "))
+			select {
+			case <-done:
+			case <-time.After(killDelay):
+				killProcessGroup(cmd)
+				<-done
 			}
 		}
 	}
 
-	for _, f := range dots.Files[rn] {
-		cacheAdd(initRun, f)
+	if err != nil {
+		fmt.Fprintf(stderr, "# cd %s; %s\n", cmd.Dir, strings.Join(cmd.Args, " "))
 	}
+	return err
+}
 
-	return out
+// ExitStatus returns the exit status of a script from the error returned by
+// runScript, -1 if the script couldn't be started
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() > 0 {
+		return exit.ExitCode()
+	}
+	return -1
 }
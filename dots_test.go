@@ -9,8 +9,8 @@
 package main
 
 import (
-	"bytes"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -27,15 +27,15 @@ func TestRead(t *testing.T) {
 	dots.read()
 
 	if len(dots.Files) != 3 {
-		t.Errorf("Dotfiles should have 3 dirs but found %s", len(dots.Files))
+		t.Errorf("Dotfiles should have 3 dirs but found %d", len(dots.Files))
 	}
 
 	if len(dots.Files[cp]) != 1 {
-		t.Errorf("copy dir should contains 1 files but found %s", len(dots.Files[cp]))
+		t.Errorf("copy dir should contains 1 files but found %d", len(dots.Files[cp]))
 	}
 
 	if len(dots.Files[ln]) != 2 {
-		t.Errorf("link dir should contains 2 files but found %s", len(dots.Files[ln]))
+		t.Errorf("link dir should contains 2 files but found %d", len(dots.Files[ln]))
 	}
 
 	cleanup()
@@ -61,14 +61,16 @@ func TestBackup(t *testing.T) {
 
 	dots.read()
 
-	dots.backup(ln, link)
+	if err := testPlan(t, dots).apply(); err != nil {
+		t.Fatal(err)
+	}
 
-	files, err := ioutil.ReadDir(filepath.Join(BaseDir, "backup"))
+	gens, err := loadGenerations()
 	if err != nil {
 		t.Error(err)
 	}
-	if len(files) != 2 {
-		t.Errorf("2 files should have been backed up, but found %v", len(files))
+	if len(gens) != 1 || len(gens[0].Entries) != 2 {
+		t.Errorf("2 files should have been backed up, but found %v", gens)
 	}
 
 	cleanup()
@@ -83,7 +85,9 @@ func TestCp(t *testing.T) {
 
 	dots.read()
 
-	dots.cp()
+	if err := testPlan(t, dots).apply(); err != nil {
+		t.Fatal(err)
+	}
 
 	// Check if all the copied files are present
 	for i := 0; i < 5; i++ {
@@ -104,7 +108,9 @@ func TestLn(t *testing.T) {
 
 	dots.read()
 
-	dots.ln()
+	if err := testPlan(t, dots).apply(); err != nil {
+		t.Fatal(err)
+	}
 
 	checkRoot := checkDir("../", 5)
 
@@ -124,11 +130,12 @@ func TestLn(t *testing.T) {
 	invalideCache()
 }
 
-// ignore
-func _TestRn(t *testing.T) {
+func TestRn(t *testing.T) {
 	initialize()
+	invalideCache()
 
-	feedDir("init", 3)("echo foo")
+	out := filepath.Join(RootDir, "out")
+	feedDir("init", 3)("#!/bin/sh\necho foo >> " + out)
 
 	expected := `foo
 foo
@@ -139,9 +146,63 @@ foo
 
 	dots.read()
 
-	out := dots.init()
+	if err := testPlan(t, dots).apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	bytes, err := ioutil.ReadFile(out)
+	if err != nil || string(bytes) != expected {
+		t.Errorf("%s\n was expected but found\n%s (%v)", expected, bytes, err)
+	}
+
+	cleanup()
+	invalideCache()
+}
+
+func TestNestedDirs(t *testing.T) {
+	initialize()
+	invalideCache()
 
-	if bytes.Compare(out, []byte(expected)) != 0 {
-		t.Errorf("%s\n was expected but found\n%s", expected, string(out))
+	for _, path := range []string{
+		"link/.config/nvim/init.lua",
+		"link/.config/git/config",
+		"link/.vim/vimrc",
+		"copy/.local/bin/tool",
+	} {
+		path = filepath.Join(BaseDir, path)
+		os.MkdirAll(filepath.Dir(path), 0777)
+		if err := ioutil.WriteFile(path, []byte("data"), 0666); err != nil {
+			t.Fatal(err)
+		}
 	}
+
+	// ~/.config exists so its sub-directories are linked one by one,
+	// while ~/.vim is linked as a whole
+	os.MkdirAll(filepath.Join(RootDir, ".config", "git"), 0777)
+
+	var dots Dotfiles
+	dots.read()
+	if err := testPlan(t, dots).apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	links := map[string]string{
+		".config/nvim":       "link/.config/nvim",
+		".config/git/config": "link/.config/git/config",
+		".vim":               "link/.vim",
+	}
+	for path, source := range links {
+		dest, err := os.Readlink(filepath.Join(RootDir, path))
+		if err != nil || dest != filepath.Join(BaseDir, source) {
+			t.Errorf("~/%s should be linked to %s but found %q (%v)", path, source, dest, err)
+		}
+	}
+
+	fi, err := os.Lstat(filepath.Join(RootDir, ".local", "bin", "tool"))
+	if err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("~/.local/bin/tool should have been copied (%v)", err)
+	}
+
+	cleanup()
+	invalideCache()
 }
@@ -10,12 +10,47 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 )
 
+var cmdInit = &Command{
+	Run:       runInit,
+	UsageLine: "init",
+	Short:     "create a new dotfiles repo from scratch",
+	Long: `
+Init scaffolds a new dotfiles repo. The new config will look like this:
+
+    ~/.dotfiles
+      |_ bin
+      |_ conf
+      |_ copy
+      |_ init
+      |_ link
+      |_ test
+      |_ source
+      |_ vendor
+`,
+}
+
+func runInit(cmd *Command, args []string) int {
+	if len(args) != 0 {
+		cmd.Usage()
+		return exitUsage
+	}
+
+	if _, err := os.Stat(BaseDir); err == nil {
+		fmt.Fprintf(os.Stderr, "dotfiles: %s already exists\n", BaseDir)
+		return exitFailure
+	}
+
+	console.printHeader("    .: Dotfiles :.")
+	initialize()
+	return exitOK
+}
+
 // Initialize creates a new .dotfiles repo
 func initialize() {
 	console.printHeader("Scaffold " + BaseDir)
@@ -24,6 +59,9 @@ func initialize() {
 		console.printArrow(dir)
 		os.MkdirAll(filepath.Join(BaseDir, dir), 0777)
 	}
+	if err := writeGitignore(); err != nil {
+		console.printKO(fmt.Sprintf("failed to write the .gitignore: %v", err))
+	}
 	if !quietMode {
 		fmt.Println("")
 	}
@@ -31,9 +69,47 @@ func initialize() {
 	console.printHeader("All done !")
 }
 
-func cpToDot(cmd, path string) {
-	if err := exec.Command("cp", path, filepath.Join(BaseDir, cmd)).Run(); err != nil {
-		log.Fatal(err)
+// CpToDot copies the file (or directory) at path into the given dotfiles dir,
+// keeping its path relative to the home directory. It returns the path of
+// the copy. The file is copied next to its place first, then renamed over a
+// file already tracked there, so a failed copy leaves the tracked file alone.
+func cpToDot(dir Dir, path string) (string, error) {
+	rel, err := filepath.Rel(RootDir, path)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+
+	dest := filepath.Join(BaseDir, dir.String(), rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(dest), "."+filepath.Base(dest)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	copied := filepath.Join(tmp, filepath.Base(dest))
+	if err := exec.Command("cp", "-R", "-p", path, copied).Run(); err != nil {
+		return "", fmt.Errorf("failed to copy %s into %s: %v", path, dest, err)
+	}
+
+	// A dir can't be renamed over, nor replace a file: move the tracked one
+	// aside, it is removed with the temp dir
+	old := filepath.Join(tmp, "old")
+	if tracked, err := os.Lstat(dest); err == nil && (tracked.IsDir() || fi.IsDir()) {
+		if err := os.Rename(dest, old); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(copied, dest); err != nil {
+		os.Rename(old, dest)
+		return "", err
 	}
-	fmt.Printf("Added %s\n", filepath.Join(BaseDir, cmd, filepath.Base(path)))
+	return dest, nil
 }
@@ -0,0 +1,296 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// Journal records the changes made while applying a plan, so they can be
+// undone if the plan fails or is interrupted. It is written on disk after
+// each change, so a run which crashed is rolled back by the next one.
+type Journal struct {
+	// Cache is the cache as it was before the run
+	Cache json.RawMessage
+
+	// Generation is the dir of the backup generation created by the run
+	Generation string `json:",omitempty"`
+
+	Entries []JournalEntry
+
+	gen *Generation
+
+	// ran is the exit status of the scripts run so far
+	ran map[string]int
+
+	// run is the log of the run
+	run *RunLog
+}
+
+// OpMkdir is the operation recorded when creating the parent dirs of a copy
+// or a link
+const opMkdir Op = "mkdir"
+
+// JournalEntry is a change made by a step
+type JournalEntry struct {
+	Op     Op
+	Source string
+	Dest   string
+
+	// Saved is where the file previously at Dest has been moved before
+	// being replaced
+	Saved string `json:",omitempty"`
+
+	// Interrupted is true for a script stopped before its end
+	Interrupted bool `json:",omitempty"`
+
+	// Run is the cache entry of a script which completed, it is kept when
+	// the run is rolled back since the script can't be undone
+	Run *Entry `json:",omitempty"`
+}
+
+// JournalDir returns the dir where the journal and the replaced files are kept
+// during a run
+func journalDir() string {
+	return filepath.Join(StateDir, "journal")
+}
+
+func journalPath() string {
+	return filepath.Join(journalDir(), "journal.json")
+}
+
+// BeginJournal starts a new journal with a snapshot of the current cache
+func beginJournal() (*Journal, error) {
+	snapshot, err := json.Marshal(&cache)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(journalDir(), 0777); err != nil {
+		return nil, fmt.Errorf("failed to create the journal dir: %v", err)
+	}
+
+	j := &Journal{Cache: snapshot, ran: make(map[string]int)}
+	return j, j.flush()
+}
+
+// LoadJournal returns the journal left by an interrupted run or nil
+func loadJournal() (*Journal, error) {
+	bytes, err := ioutil.ReadFile(journalPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var j Journal
+	if err := json.Unmarshal(bytes, &j); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the journal %s: %v", journalPath(), err)
+	}
+	return &j, nil
+}
+
+// RecoverJournal rolls back the run which didn't complete, if any
+func recoverJournal() error {
+	j, err := loadJournal()
+	if err != nil || j == nil {
+		return err
+	}
+
+	console.printHeader("Rolling back the interrupted run")
+	return j.rollback()
+}
+
+func (j *Journal) flush() error {
+	bytes, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(journalPath(), bytes)
+}
+
+// Save moves the file at path out of the way before it is replaced.
+// It returns where the file has been moved, or "" if there was no file.
+func (j *Journal) save(path string) (string, error) {
+	if _, err := os.Lstat(path); err != nil {
+		return "", nil
+	}
+
+	saved := filepath.Join(journalDir(), strconv.Itoa(len(j.Entries)))
+	if err := exec.Command("mv", path, saved).Run(); err != nil {
+		return "", fmt.Errorf("failed to move %s out of the way: %v", path, err)
+	}
+	return saved, nil
+}
+
+// Generation returns the backup generation of the run, it is created by the
+// first backup
+func (j *Journal) generation() (*Generation, error) {
+	if j.gen != nil {
+		return j.gen, nil
+	}
+
+	gen, err := newGeneration()
+	if err != nil {
+		return nil, err
+	}
+	j.gen = gen
+	j.Generation = gen.Dir
+	return gen, j.flush()
+}
+
+// MkdirAll creates the missing parents of path and records them, in the
+// journal and in the cache so uninstall and prune can remove them
+func (j *Journal) mkdirAll(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if err := j.mkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(path, 0777); err != nil {
+		return err
+	}
+	if err := j.record(JournalEntry{Op: opMkdir, Dest: path}); err != nil {
+		return err
+	}
+	return cacheAdd(createdDir, path)
+}
+
+// Record adds a change to the journal
+func (j *Journal) record(entry JournalEntry) error {
+	j.Entries = append(j.Entries, entry)
+	return j.flush()
+}
+
+// FailedRequirement returns the first of the required scripts which didn't
+// succeed: it failed during this run, or it was not run and its last run
+// failed or never happened. It returns "" if all of them succeeded.
+func (j *Journal) failedRequirement(requires []string) string {
+	for _, req := range requires {
+		if status, ok := j.ran[req]; ok {
+			if status != 0 {
+				return req
+			}
+			continue
+		}
+		if entry, ok := cacheGet(initRun, req); !ok || entry.Status != 0 {
+			return req
+		}
+	}
+	return ""
+}
+
+// Commit writes the cache and discards the journal once the run succeeded
+func (j *Journal) commit() error {
+	if err := flushCache(); err != nil {
+		return err
+	}
+	return os.RemoveAll(journalDir())
+}
+
+// Rollback undoes the recorded changes in reverse order and restores the cache
+func (j *Journal) rollback() error {
+	var errs []error
+	var failed []JournalEntry
+	var interrupted []string
+	var completed []JournalEntry
+
+	for i := len(j.Entries) - 1; i >= 0; i-- {
+		e := j.Entries[i]
+
+		switch e.Op {
+		case opBackup:
+			// Put the original file back
+			if err := exec.Command("mv", e.Dest, e.Source).Run(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to restore %s: %v", e.Source, err))
+				failed = append([]JournalEntry{e}, failed...)
+				continue
+			}
+			console.printArrow("restored " + shortPath(e.Source))
+
+		case opCopy, opLink:
+			// Remove the new file and put back the one it replaced
+			if err := os.Remove(e.Dest); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+				failed = append([]JournalEntry{e}, failed...)
+				continue
+			}
+			if e.Saved != "" {
+				if err := exec.Command("mv", e.Saved, e.Dest).Run(); err != nil {
+					errs = append(errs, fmt.Errorf("failed to restore %s: %v", e.Dest, err))
+					failed = append([]JournalEntry{{Op: opBackup, Source: e.Dest, Dest: e.Saved}}, failed...)
+					continue
+				}
+			}
+			console.printArrow("removed " + shortPath(e.Dest))
+
+		case opMkdir:
+			// Only remove the dir if it is still empty
+			os.Remove(e.Dest)
+
+		case opRun:
+			if e.Interrupted {
+				console.printKO(filepath.Base(e.Source) + " has been interrupted and can't be undone")
+				interrupted = append(interrupted, e.Source)
+				continue
+			}
+			console.printKO(filepath.Base(e.Source) + " has been run and can't be undone")
+			if e.Run != nil {
+				completed = append(completed, e)
+			}
+		}
+	}
+
+	cache = Cache{}
+	if err := json.Unmarshal(j.Cache, &cache); err != nil {
+		errs = append(errs, fmt.Errorf("failed to restore the cache: %v", err))
+	} else {
+		// The interrupted scripts are proposed again by the next run, the
+		// completed ones are not
+		for _, f := range interrupted {
+			cacheRemove(initRun, f)
+		}
+		for _, e := range completed {
+			if cache.InitRun == nil {
+				cache.InitRun = make(map[string]Entry)
+			}
+			cache.InitRun[cacheKey(e.Source)] = *e.Run
+		}
+
+		cacheChanged = true
+		if err := flushCache(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == 0 && j.Generation != "" {
+		// All the backed up files are back in place
+		if err := os.RemoveAll(j.Generation); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		// Keep what failed in the journal to retry later
+		j.Entries = failed
+		j.flush()
+		return fmt.Errorf("failed to roll back: %v", errs)
+	}
+	return j.commit()
+}
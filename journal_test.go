@@ -0,0 +1,111 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	feedDir("copy", 2)("data")
+	cacheAdd(copy, filepath.Join(BaseDir, "copy", mockFileName(1)))
+
+	// The first file will be backed up, the second one overwritten
+	for i := 0; i < 2; i++ {
+		err := ioutil.WriteFile(filepath.Join(RootDir, mockFileName(i)), []byte("old data"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var dots Dotfiles
+	dots.read()
+
+	plan := testPlan(t, dots)
+	plan.Steps = append(plan.Steps, Step{Op: "fail"})
+
+	if err := plan.apply(); err == nil {
+		t.Fatal("the plan should have failed")
+	}
+
+	if err := checkDir("..", 2)("old data"); err != nil {
+		t.Errorf("the files should have been restored: %v", err)
+	}
+
+	// A step failing before the last one stops the plan too
+	last := len(plan.Steps) - 2
+	plan.Steps = append(plan.Steps[:last:last], Step{Op: "fail"}, plan.Steps[last])
+	if err := plan.apply(); err == nil {
+		t.Fatal("the plan should have failed before its last step")
+	}
+
+	if err := checkDir("..", 2)("old data"); err != nil {
+		t.Errorf("the files should have been restored: %v", err)
+	}
+
+	if b, _ := cacheContains(copy, filepath.Join(BaseDir, "copy", mockFileName(0))); b {
+		t.Errorf("the cache should have been restored")
+	}
+	if b, _ := cacheContains(copy, filepath.Join(BaseDir, "copy", mockFileName(1))); !b {
+		t.Errorf("the cache should have been restored")
+	}
+
+	if _, err := os.Stat(journalDir()); !os.IsNotExist(err) {
+		t.Errorf("the journal should have been removed")
+	}
+
+	cleanup()
+	invalideCache()
+}
+
+func TestRecoverJournal(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	feedDir("link", 1)("data")
+	script := writeScript(t, "ran.sh", "exit 3", 0666)
+
+	var dots Dotfiles
+	dots.read()
+
+	// Simulate a crash after the link and the script
+	j, err := beginJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range testPlan(t, dots).Steps {
+		if err := step.apply(context.Background(), j); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := recoverJournal(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(RootDir, mockFileName(0))); !os.IsNotExist(err) {
+		t.Errorf("the link should have been removed")
+	}
+	if len(cache.Link) != 0 {
+		t.Errorf("the cache should be empty but found %v", cache.Link)
+	}
+	if entry, ok := cacheGet(initRun, script); !ok || entry.Status != 3 {
+		t.Errorf("the run of the script should be kept, found %v", entry)
+	}
+
+	cleanup()
+	invalideCache()
+}
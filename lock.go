@@ -0,0 +1,114 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LockedError is returned when another dotfiles process holds the lock
+type LockedError struct {
+	PID int
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("another dotfiles process (PID %d) is running on %s, wait for it or use -wait", e.PID, BaseDir)
+}
+
+func lockPath() string {
+	return filepath.Join(StateDir, "lock")
+}
+
+// Lock takes the lock of the state dir so only one dotfiles process changes
+// the repo state at once. If the lock is held by another process, it waits
+// for it to release the lock up to the given duration. A lock left by a
+// process which died is taken over.
+func lock(wait time.Duration) error {
+	if err := os.MkdirAll(StateDir, 0777); err != nil {
+		return fmt.Errorf("failed to create the state dir: %v", err)
+	}
+
+	// The lock file is linked once written so its PID is always readable
+	tmp := lockPath() + "." + strconv.Itoa(os.Getpid())
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0666); err != nil {
+		return fmt.Errorf("failed to create the lock file: %v", err)
+	}
+	defer os.Remove(tmp)
+
+	deadline := time.Now().Add(wait)
+	for {
+		err := os.Link(tmp, lockPath())
+		if err == nil {
+			return nil
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("failed to create the lock file: %v", err)
+		}
+
+		pid := lockOwner()
+		if pid == 0 || !processAlive(pid) {
+			takeOver(pid)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return &LockedError{pid}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Unlock releases the lock taken by lock
+func unlock() {
+	if locked() {
+		os.Remove(lockPath())
+	}
+}
+
+// TakeOver removes the stale lock left by the process pid. Another process
+// may have replaced it since its PID was read: the lock is renamed first and
+// put back if it isn't the stale one.
+func takeOver(pid int) {
+	stale := lockPath() + ".stale." + strconv.Itoa(os.Getpid())
+	if err := os.Rename(lockPath(), stale); err != nil {
+		return
+	}
+	if readPID(stale) != pid {
+		os.Link(stale, lockPath())
+	}
+	os.Remove(stale)
+}
+
+// Locked returns true if this process holds the lock
+func locked() bool {
+	return lockOwner() == os.Getpid()
+}
+
+// LockOwner returns the PID written in the lock file, or 0 if it can't be read
+func lockOwner() int {
+	return readPID(lockPath())
+}
+
+func readPID(path string) int {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bytes)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
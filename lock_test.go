@@ -0,0 +1,86 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	initialize()
+
+	if err := lock(0); err != nil {
+		t.Fatal(err)
+	}
+	if lockOwner() != os.Getpid() {
+		t.Errorf("the lock should be owned by %d, not %d", os.Getpid(), lockOwner())
+	}
+	unlock()
+
+	// A lock held by a running process
+	sleep := exec.Command("sleep", "10")
+	if err := sleep.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sleep.Process.Kill()
+	ioutil.WriteFile(lockPath(), []byte(strconv.Itoa(sleep.Process.Pid)), 0666)
+
+	err := lock(200 * time.Millisecond)
+	if e, ok := err.(*LockedError); !ok || e.PID != sleep.Process.Pid {
+		t.Errorf("expected the lock to be held by %d, but got %v", sleep.Process.Pid, err)
+	}
+
+	// A lock left by a process which died
+	sleep.Process.Kill()
+	sleep.Wait()
+	if err := lock(0); err != nil {
+		t.Errorf("the stale lock should be taken over, but got %v", err)
+	}
+	unlock()
+
+	// A lock taken by another process since the stale one was read
+	ioutil.WriteFile(lockPath(), []byte(strconv.Itoa(os.Getppid())), 0666)
+	takeOver(sleep.Process.Pid)
+	if lockOwner() != os.Getppid() {
+		t.Errorf("the lock of %d should have been kept, found %d", os.Getppid(), lockOwner())
+	}
+	os.Remove(lockPath())
+
+	cleanup()
+}
+
+func TestFlushCacheBatched(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	cacheAdd(link, "file1")
+	if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+		t.Errorf("the cache should not be written before the flush")
+	}
+
+	if err := flushCache(); err != nil {
+		t.Fatal(err)
+	}
+	isPresent(t, StateDir, "cache.json")
+
+	files, _ := ioutil.ReadDir(StateDir)
+	for _, f := range files {
+		if f.Name() != "cache.json" {
+			t.Errorf("unexpected file %s left in the state dir", f.Name())
+		}
+	}
+
+	cleanup()
+	invalideCache()
+}
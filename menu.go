@@ -0,0 +1,313 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Menu is the full-screen selector of the init scripts
+type menu struct {
+	scripts  []string
+	selected map[string]bool
+	notes    map[string]string
+
+	// invalid are the scripts which can't be run, they can't be selected
+	invalid map[string]string
+
+	// cursor is the index of the current script among the visible ones,
+	// offset the index of the first one on the screen
+	cursor int
+	offset int
+
+	// filter only shows the scripts whose name contains it, it is edited
+	// while filtering is true
+	filter    string
+	filtering bool
+}
+
+// Result of a key press
+const (
+	menuContinue = iota
+	menuDone
+	menuCanceled
+	menuInterrupted
+)
+
+// ErrDumbTerminal is returned when the terminal can't show the menu
+var errDumbTerminal = errors.New("the terminal can't show the menu")
+
+// SelectMenu lets the user edit the selection of the init scripts with the
+// keyboard. It returns errDumbTerminal, or the error of the terminal, if the
+// menu can't be shown, and an InterruptedError on ctrl-c.
+func (c Console) selectMenu(scripts []string, selected map[string]bool, notes, invalid map[string]string) (map[string]bool, error) {
+	term := os.Getenv("TERM")
+	if quietMode || term == "" || term == "dumb" || !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return nil, errDumbTerminal
+	}
+
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	defer restore()
+
+	m := &menu{scripts: scripts, selected: make(map[string]bool), notes: notes, invalid: invalid}
+	for f, ok := range selected {
+		m.selected[f] = ok
+	}
+
+	// Use the alternate screen without cursor nor line wrapping
+	fmt.Print("\033[?1049h\033[?25l\033[?7l")
+	defer fmt.Print("\033[?7h\033[?25h\033[?1049l")
+
+	for {
+		_, height, err := terminalSize(os.Stdout)
+		if err != nil || height == 0 {
+			height = 24
+		}
+		var screen bytes.Buffer
+		m.render(&screen, height)
+		os.Stdout.Write(screen.Bytes())
+
+		key, err := readKey(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+
+		switch m.handle(key) {
+		case menuDone:
+			return m.selected, nil
+		case menuCanceled:
+			return selected, nil
+		case menuInterrupted:
+			return nil, &InterruptedError{os.Interrupt}
+		}
+	}
+}
+
+// ReadKey reads a key press: the character typed, or the name of a special
+// key (up, down, enter, esc, backspace, ctrl-c)
+func readKey(r io.Reader) (string, error) {
+	buf := make([]byte, 16)
+	n, err := r.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	buf = buf[:n]
+
+	switch {
+	case bytes.Equal(buf, []byte("\033[A")), bytes.Equal(buf, []byte("\033OA")):
+		return "up", nil
+	case bytes.Equal(buf, []byte("\033[B")), bytes.Equal(buf, []byte("\033OB")):
+		return "down", nil
+	case len(buf) > 1 && buf[0] == '\033':
+		// Another escape sequence
+		return "", nil
+	}
+
+	switch buf[0] {
+	case '\r', '\n':
+		return "enter", nil
+	case '\033':
+		return "esc", nil
+	case 0x7f, '\b':
+		return "backspace", nil
+	case 0x03:
+		return "ctrl-c", nil
+	}
+	return string(buf), nil
+}
+
+// Visible returns the scripts matching the filter
+func (m *menu) visible() []string {
+	if m.filter == "" {
+		return m.scripts
+	}
+
+	var res []string
+	for _, f := range m.scripts {
+		if strings.Contains(strings.ToLower(filepath.Base(f)), strings.ToLower(m.filter)) {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// Handle updates the menu after a key press
+func (m *menu) handle(key string) int {
+	visible := m.visible()
+
+	switch key {
+	case "ctrl-c":
+		return menuInterrupted
+	case "up":
+		if m.cursor > 0 {
+			m.cursor--
+		}
+		return menuContinue
+	case "down":
+		if m.cursor < len(visible)-1 {
+			m.cursor++
+		}
+		return menuContinue
+	}
+
+	if m.filtering {
+		switch key {
+		case "enter":
+			m.filtering = false
+		case "esc":
+			m.filter = ""
+			m.filtering = false
+		case "backspace":
+			if m.filter != "" {
+				m.filter = m.filter[:len(m.filter)-1]
+			}
+		case "":
+		default:
+			m.filter += key
+			m.cursor = 0
+			m.offset = 0
+		}
+		return menuContinue
+	}
+
+	switch key {
+	case "enter":
+		return menuDone
+	case "esc", "q":
+		return menuCanceled
+	case "k":
+		return m.handle("up")
+	case "j":
+		return m.handle("down")
+	case " ":
+		if m.cursor < len(visible) {
+			f := visible[m.cursor]
+			if m.invalid[f] == "" {
+				m.selected[f] = !m.selected[f]
+			}
+		}
+	case "a":
+		// Select all the visible scripts, or none if they all are
+		all := true
+		for _, f := range visible {
+			if m.invalid[f] == "" && !m.selected[f] {
+				all = false
+			}
+		}
+		for _, f := range visible {
+			if m.invalid[f] == "" {
+				m.selected[f] = !all
+			}
+		}
+	case "/":
+		m.filtering = true
+	}
+	return menuContinue
+}
+
+// Render draws the menu on a screen of the given height
+func (m *menu) render(w io.Writer, height int) {
+	fmt.Fprint(w, "\033[H\033[2J")
+	fmt.Fprint(w, "\033[1mSelect the init scripts to run\033[0m\n")
+	fmt.Fprint(w, "\033[2m↑/↓ move  space toggle  a all  / filter  enter confirm  esc cancel\033[0m\n")
+
+	header := 3
+	if m.filtering || m.filter != "" {
+		fmt.Fprintf(w, "/%s\n", m.filter)
+		header++
+	}
+	fmt.Fprint(w, "\n")
+
+	visible := m.visible()
+	if len(visible) == 0 {
+		fmt.Fprint(w, " no script matches\n")
+		return
+	}
+
+	// Scroll to keep the cursor on the screen
+	rows := height - header - 1
+	if rows < 1 {
+		rows = 1
+	}
+	if m.cursor < m.offset {
+		m.offset = m.cursor
+	}
+	if m.cursor >= m.offset+rows {
+		m.offset = m.cursor - rows + 1
+	}
+
+	// The columns are as wide as their longest value
+	width, runWidth := 0, 0
+	runs := make(map[string]string)
+	for _, f := range visible {
+		if n := utf8.RuneCountInString(filepath.Base(f)); n > width {
+			width = n
+		}
+		runs[f] = lastRun(f)
+		if n := utf8.RuneCountInString(runs[f]); n > runWidth {
+			runWidth = n
+		}
+	}
+
+	for i := m.offset; i < len(visible) && i < m.offset+rows; i++ {
+		f := visible[i]
+
+		check := "[ ]"
+		if m.selected[f] {
+			// Only reset the color to keep the cursor line highlighted
+			check = "[\033[1;32mx\033[22;39m]"
+		}
+		line := fmt.Sprintf("%s %s  %s %s", check, padRight(filepath.Base(f), width), padRight(runs[f], runWidth), m.notes[f])
+
+		switch {
+		case i == m.cursor:
+			fmt.Fprintf(w, "\033[1;34m❯\033[0m \033[7m%s\033[0m\n", line)
+		case m.invalid[f] != "":
+			fmt.Fprintf(w, "  \033[2m%s\033[0m\n", line)
+		default:
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+}
+
+// PadRight pads s with spaces up to n characters. Unlike fmt, it counts the
+// characters rather than the bytes, so the columns stay aligned with ✔ and ✖.
+func padRight(s string, n int) string {
+	if pad := n - utf8.RuneCountInString(s); pad > 0 {
+		return s + strings.Repeat(" ", pad)
+	}
+	return s
+}
+
+// LastRun describes the last run of the script recorded in the cache
+func lastRun(f string) string {
+	entry, ok := cacheGet(initRun, f)
+	if !ok {
+		return "never run"
+	}
+
+	res := "✔ succeeded"
+	if entry.Status != 0 {
+		res = fmt.Sprintf("✖ exit status %d", entry.Status)
+	}
+	if !entry.Time.IsZero() {
+		res += " " + entry.Time.Format("2006-01-02 15:04")
+	}
+	return res
+}
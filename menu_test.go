@@ -0,0 +1,148 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestReadKey(t *testing.T) {
+	tests := map[string]string{
+		"\033[A": "up",
+		"\033OB": "down",
+		"\r":     "enter",
+		"\033":   "esc",
+		"\x7f":   "backspace",
+		"\x03":   "ctrl-c",
+		"a":      "a",
+		"\033[D": "",
+	}
+	for input, expected := range tests {
+		key, err := readKey(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != expected {
+			t.Errorf("%q: expected %q, found %q", input, expected, key)
+		}
+	}
+}
+
+func TestMenu(t *testing.T) {
+	m := &menu{
+		scripts:  []string{"/init/brew.sh", "/init/fonts.sh", "/init/zsh.sh", "/init/broken.sh"},
+		selected: map[string]bool{"/init/brew.sh": true},
+		invalid:  map[string]string{"/init/broken.sh": "dependency cycle"},
+	}
+	press := func(keys ...string) int {
+		res := menuContinue
+		for _, key := range keys {
+			res = m.handle(key)
+		}
+		return res
+	}
+
+	// Toggle the second script
+	press("down", " ")
+	if !m.selected["/init/fonts.sh"] {
+		t.Error("fonts.sh should be selected")
+	}
+
+	// Select all but the invalid script, then none
+	press("a")
+	if !m.selected["/init/zsh.sh"] || m.selected["/init/broken.sh"] {
+		t.Errorf("all the valid scripts should be selected, found %v", m.selected)
+	}
+	press("a")
+	if m.selected["/init/brew.sh"] || m.selected["/init/zsh.sh"] {
+		t.Errorf("no script should be selected, found %v", m.selected)
+	}
+
+	// Filter the scripts then toggle the first match
+	press("/", "z", "s", "enter", " ")
+	if !reflect.DeepEqual(m.visible(), []string{"/init/zsh.sh"}) || !m.selected["/init/zsh.sh"] {
+		t.Errorf("zsh.sh should be filtered and selected, found %v %v", m.visible(), m.selected)
+	}
+	press("/", "esc")
+	if len(m.visible()) != 4 {
+		t.Error("esc should clear the filter")
+	}
+
+	// The invalid script can't be selected
+	press("down", "down", "down", "down", " ")
+	if m.selected["/init/broken.sh"] {
+		t.Error("an invalid script should not be selectable")
+	}
+
+	if press("enter") != menuDone || press("esc") != menuCanceled || press("ctrl-c") != menuInterrupted {
+		t.Error("expected enter to confirm, esc to cancel and ctrl-c to interrupt")
+	}
+}
+
+func TestRenderMenu(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	var scripts []string
+	for _, name := range []string{"a.sh", "b.sh", "c.sh", "d.sh", "e.sh"} {
+		scripts = append(scripts, writeScript(t, name, "true", 0666))
+	}
+	cacheRun(scripts[1], 3)
+
+	m := &menu{scripts: scripts, selected: map[string]bool{}, cursor: 4}
+	var screen bytes.Buffer
+	m.render(&screen, 7)
+
+	// Only 3 scripts fit, the screen is scrolled to the cursor
+	out := screen.String()
+	if strings.Contains(out, "a.sh") || strings.Contains(out, "b.sh") || !strings.Contains(out, "e.sh") {
+		t.Errorf("the menu should be scrolled to e.sh, found %q", out)
+	}
+
+	m.cursor = 0
+	screen.Reset()
+	m.render(&screen, 7)
+	if !strings.Contains(screen.String(), "exit status 3") || !strings.Contains(screen.String(), "never run") {
+		t.Errorf("the last run of the scripts should be shown, found %q", screen.String())
+	}
+
+	// The notes are aligned after a never run script and a failed one
+	m.cursor = 2
+	m.notes = map[string]string{scripts[0]: "note", scripts[1]: "note"}
+	screen.Reset()
+	m.render(&screen, 7)
+	columns := map[int]bool{}
+	for _, line := range strings.Split(screen.String(), "\n") {
+		if i := strings.Index(line, "note"); i >= 0 {
+			columns[utf8.RuneCountInString(line[:i])] = true
+		}
+	}
+	if len(columns) != 1 {
+		t.Errorf("the notes should be aligned, found %q", screen.String())
+	}
+
+	cleanup()
+}
+
+func TestParseIDs(t *testing.T) {
+	ids, err := parseIDs("0, 2 3\n", 4)
+	if err != nil || !reflect.DeepEqual(ids, []int{0, 2, 3}) {
+		t.Errorf("expected [0 2 3], found %v (%v)", ids, err)
+	}
+
+	for _, text := range []string{"1 x", "4", "-1"} {
+		if _, err := parseIDs(text, 4); err == nil {
+			t.Errorf("%q should be rejected", text)
+		}
+	}
+}
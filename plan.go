@@ -0,0 +1,361 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Op is the operation done by a step of a plan
+type Op string
+
+// List of the operations
+const (
+	opBackup Op = "backup"
+	opCopy   Op = "copy"
+	opLink   Op = "link"
+	opRun    Op = "run"
+	opSkip   Op = "skip"
+)
+
+// Action returns the cached action corresponding to the operation
+func (op Op) action() Action {
+	var a Action
+	switch op {
+	case opCopy:
+		a = copy
+	case opLink:
+		a = link
+	case opRun, opSkip:
+		a = initRun
+	}
+	return a
+}
+
+// Step is a single operation of a plan
+type Step struct {
+	Op     Op
+	Source string
+	Dest   string `json:",omitempty"`
+
+	// Hash is the hash of the source when the plan was made
+	Hash string `json:",omitempty"`
+
+	// Requires lists the scripts which must succeed before running a script
+	Requires []string `json:",omitempty"`
+
+	// Reason explains why a file is backed up or a script is run
+	Reason string `json:",omitempty"`
+}
+
+// Plan lists the steps to apply the dotfiles in the home directory.
+// A plan can be saved and applied later, as long as the sources
+// didn't change in the meantime.
+type Plan struct {
+	RootDir string
+	BaseDir string
+	Steps   []Step
+
+	// failed are the init scripts which failed or were skipped by the last
+	// apply
+	failed []string
+}
+
+func newPlan() *Plan {
+	return &Plan{RootDir: RootDir, BaseDir: BaseDir}
+}
+
+func loadPlan(path string) (*Plan, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var plan Plan
+	if err := json.Unmarshal(bytes, &plan); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the plan %s: %v", path, err)
+	}
+	return &plan, nil
+}
+
+func (p *Plan) save(path string) error {
+	bytes, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, bytes, 0666)
+}
+
+func (p *Plan) print() {
+	console.printHeader("Plan")
+
+	if len(p.Steps) == 0 {
+		console.print(" nothing to do\n")
+	}
+	for _, step := range p.Steps {
+		console.print(fmt.Sprintf(" %-7s%s\n", step.Op, step))
+	}
+}
+
+// Check verifies that the plan can be applied on this machine and that the
+// sources didn't change since the plan was made
+func (p *Plan) check() error {
+	if p.RootDir != RootDir || p.BaseDir != BaseDir {
+		return fmt.Errorf("the plan was made for %s", p.BaseDir)
+	}
+
+	for _, step := range p.Steps {
+		if step.Hash != "" && hashFile(step.Source) != step.Hash {
+			return fmt.Errorf("%s has changed since the plan was made", step.Source)
+		}
+	}
+	return nil
+}
+
+// Apply runs the steps of the plan as a transaction: at the first failure,
+// or if the command is interrupted, the changes already made are rolled back.
+func (p *Plan) apply() error {
+	if err := p.check(); err != nil {
+		return err
+	}
+
+	j, err := beginJournal()
+	if err != nil {
+		return err
+	}
+
+	// Every run is logged, even if it does nothing
+	run, err := j.runLog()
+	if err != nil {
+		return err
+	}
+
+	// A signal cancels the context, it is forwarded to the running scripts
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case sig := <-sigs:
+			cancel(&InterruptedError{sig})
+		case <-ctx.Done():
+		}
+	}()
+
+	var last Op
+	for i := 0; i < len(p.Steps); i++ {
+		step := p.Steps[i]
+
+		if cause := context.Cause(ctx); cause != nil {
+			err = cause
+			break
+		}
+
+		if *applyJobs > 1 && (step.Op == opRun || step.Op == opSkip) {
+			// Run all the scripts at once
+			n := i
+			for n < len(p.Steps) && (p.Steps[n].Op == opRun || p.Steps[n].Op == opSkip) {
+				n++
+			}
+			if err = j.runParallel(ctx, p.Steps[i:n], *applyJobs); err != nil {
+				break
+			}
+			i = n - 1
+			continue
+		}
+
+		if step.Op != last {
+			switch step.Op {
+			case opBackup:
+				console.printHeader("Backup existing files")
+			case opCopy:
+				console.printHeader("Copying files into home directory")
+			case opLink:
+				console.printHeader("Linking files into home directory")
+			}
+			last = step.Op
+		}
+
+		err = step.apply(ctx, j)
+		if step.Op != opRun {
+			// The scripts are logged when they are done
+			logged := RunStep{Op: step.Op, Source: step.Source, Dest: step.Dest, Reason: step.Reason}
+			if err != nil {
+				logged.Error = err.Error()
+			}
+			if lerr := j.logStep(logged); lerr != nil && err == nil {
+				err = lerr
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		// The last step may have been interrupted
+		err = context.Cause(ctx)
+	}
+
+	if err != nil {
+		console.printHeader("Rolling back: " + err.Error())
+		if rerr := j.rollback(); rerr != nil {
+			err = fmt.Errorf("%v, then %v", err, rerr)
+		}
+		run.finish(err)
+		return err
+	}
+	if err := j.commit(); err != nil {
+		run.finish(err)
+		return err
+	}
+
+	p.failed = nil
+	for f, status := range j.ran {
+		if status != 0 {
+			p.failed = append(p.failed, filepath.Base(f))
+		}
+	}
+	sort.Strings(p.failed)
+	return run.finish(nil)
+}
+
+// FailedScripts returns an error listing the init scripts which didn't
+// succeed during the last apply, or nil. Since a failing script doesn't stop
+// the plan, it lets the callers report a broken setup.
+func (p *Plan) failedScripts() error {
+	if len(p.failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d init scripts didn't succeed: %s", len(p.failed), strings.Join(p.failed, ", "))
+}
+
+func (s Step) apply(ctx context.Context, j *Journal) error {
+	switch s.Op {
+	case opBackup:
+		gen, err := j.generation()
+		if err != nil {
+			return err
+		}
+		backup, err := gen.add(s.Source, s.Reason)
+		if err != nil {
+			return err
+		}
+		fmt.Printf(" %s ➜ %s\n", shortPath(s.Source), shortPath(backup))
+		return j.record(JournalEntry{Op: s.Op, Source: s.Source, Dest: backup})
+
+	case opCopy, opLink:
+		console.printArrow(shortPath(s.Dest))
+
+		saved, err := j.save(s.Dest)
+		if err != nil {
+			return err
+		}
+
+		if err := j.mkdirAll(filepath.Dir(s.Dest)); err != nil {
+			return fmt.Errorf("failed to create the parent dirs of %s: %v", s.Dest, err)
+		}
+
+		cmd := exec.Command("cp", s.Source, s.Dest)
+		if s.Op == opLink {
+			cmd = exec.Command("ln", "-s", s.Source, s.Dest)
+		}
+		err = cmd.Run()
+
+		// Record the change even if it failed, so the saved file is put back
+		if rerr := j.record(JournalEntry{Op: s.Op, Source: s.Source, Dest: s.Dest, Saved: saved}); rerr != nil {
+			return rerr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to %s %s: %v", s.Op, s.Source, err)
+		}
+		cacheAdd(s.Op.action(), s.Source)
+
+	case opRun:
+		console.printHeader("Run " + filepath.Base(s.Source))
+
+		if req := j.failedRequirement(s.Requires); req != "" {
+			return j.skipScript(s, req)
+		}
+
+		logFile, err := j.openLog(s.Source)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+
+		// A failing script doesn't stop the plan
+		start := time.Now()
+		err = runScript(ctx, s.Source, io.MultiWriter(os.Stdout, logFile), io.MultiWriter(os.Stderr, logFile))
+		if err != nil {
+			console.printKO(err.Error())
+		}
+		return j.scriptDone(s, start, err)
+
+	case opSkip:
+		// A script deselected by the user isn't proposed again until it
+		// changes, the others are proposed again next time
+		if s.Reason == deselected {
+			return cacheAdd(initDeselected, s.Source)
+		}
+
+	default:
+		return fmt.Errorf("unknown operation %q", s.Op)
+	}
+	return nil
+}
+
+func (s Step) String() string {
+	switch s.Op {
+	case opBackup:
+		return shortPath(s.Source) + " (" + s.Reason + ")"
+	case opRun, opSkip:
+		if s.Reason != "" {
+			return shortPath(s.Source) + " (" + s.Reason + ")"
+		}
+		return shortPath(s.Source)
+	}
+	return shortPath(s.Source) + " ➜ " + shortPath(s.Dest)
+}
+
+// HashFile returns the SHA-256 of the file content, or "" if the file is
+// not a regular file
+func hashFile(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+		return ""
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	initialize()
+
+	feedDir("copy", 2)("data")
+	feedDir("init", 1)("echo foo")
+
+	err := ioutil.WriteFile(filepath.Join(RootDir, mockFileName(0)), []byte("old data"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dots Dotfiles
+	dots.read()
+	plan := testPlan(t, dots)
+
+	expected := []Op{opBackup, opCopy, opCopy, opRun}
+	if len(plan.Steps) != len(expected) {
+		t.Fatalf("expected %d steps but found %v", len(expected), plan.Steps)
+	}
+	for i, step := range plan.Steps {
+		if step.Op != expected[i] {
+			t.Errorf("expected step %d to be %s but found %s", i, expected[i], step)
+		}
+	}
+
+	// Nothing should have changed
+	if err := checkDir("..", 1)("old data"); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(RootDir, mockFileName(1))); !os.IsNotExist(err) {
+		t.Errorf("the plan should not copy anything")
+	}
+
+	cleanup()
+	invalideCache()
+}
+
+func TestSavedPlan(t *testing.T) {
+	initialize()
+
+	feedDir("copy", 1)("data")
+
+	var dots Dotfiles
+	dots.read()
+
+	path := filepath.Join(RootDir, "plan.json")
+	if err := testPlan(t, dots).save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := loadPlan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The plan can't be applied once the source has changed
+	feedDir("copy", 1)("new data")
+	if err := plan.apply(); err == nil {
+		t.Errorf("a stale plan should not be applied")
+	}
+
+	feedDir("copy", 1)("data")
+	if err := plan.apply(); err != nil {
+		t.Errorf("Failed to apply the plan: %v", err)
+	}
+	if err := checkDir("..", 1)("data"); err != nil {
+		t.Error(err)
+	}
+
+	cleanup()
+	invalideCache()
+}
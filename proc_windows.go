@@ -0,0 +1,34 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// SetProcessGroup starts the command in its own process group, so the
+// console interrupts are not sent to it directly
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// SignalProcessGroup stops the command. Windows can't forward a signal to
+// a process group, so the command is killed.
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	return cmd.Process.Kill()
+}
+
+// KillProcessGroup kills the command
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
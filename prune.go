@@ -0,0 +1,117 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var cmdPrune = &Command{
+	UsageLine: "prune [-yes] [-dry-run]",
+	Short:     "remove the links and copies of the files removed from the repo",
+	Long: `
+Prune looks for the files which have been applied but are no longer in the
+dotfiles repo. Their links are removed if they still point into the repo and
+they are forgotten by the cache.
+
+The copies are removed only if they didn't change since they were copied.
+The copies made before dotfiles recorded their hash can't be checked anymore:
+they are reported and kept in the cache until they are removed by hand. The
+dirs created by dotfiles to hold the files are removed once empty.
+
+The removal is confirmed first. Like the global flag, -yes answers yes; with
+-non-interactive or without terminal, nothing is removed.
+`,
+	Lock: true,
+}
+
+var pruneDryRun = cmdPrune.Flag.Bool("dry-run", false, "Print what would be done without doing it.")
+
+func init() {
+	cmdPrune.Run = runPrune
+	cmdPrune.Flag.BoolVar(assumeYes, "yes", false, "Don't ask for confirmation, same as the global -yes.")
+}
+
+func runPrune(cmd *Command, args []string) int {
+	if len(args) != 0 {
+		cmd.Usage()
+		return exitUsage
+	}
+
+	if !repoExists() {
+		return exitFailure
+	}
+	loadCache()
+
+	var dots Dotfiles
+	dots.read()
+	removals := dots.planPrune()
+
+	count := 0
+	for _, r := range removals {
+		if r.Reason == "" {
+			count++
+		}
+	}
+
+	if *pruneDryRun {
+		printRemovals(removals)
+		return exitOK
+	}
+
+	if count > 0 && !console.confirm(fmt.Sprintf("Remove %d orphaned files from %s?", count, RootDir)) {
+		return exitFailure
+	}
+
+	prune(removals)
+	printRemovals(removals)
+	return exitOK
+}
+
+// PlanPrune checks the cached files which are no longer in the repo
+func (dots Dotfiles) planPrune() []Removal {
+	var removals []Removal
+
+	for _, st := range dots.status() {
+		if st.State != untracked {
+			continue
+		}
+
+		if st.Dir == ln {
+			removals = append(removals, linkRemoval(st.Source))
+			continue
+		}
+
+		removals = append(removals, copyRemoval(st.Source))
+	}
+	return removals
+}
+
+// Prune removes the orphaned files. The links are forgotten even if they are
+// left alone since they don't point into the repo anymore, the copies only
+// once they are removed.
+func prune(removals []Removal) {
+	for i := range removals {
+		r := &removals[i]
+
+		if r.Reason == "" {
+			if err := os.Remove(r.Target); err != nil {
+				r.Reason = err.Error()
+				continue
+			}
+			removeCreatedDirs(filepath.Dir(r.Target))
+		}
+
+		if _, err := os.Lstat(r.Target); r.Action == link || os.IsNotExist(err) {
+			cacheRemove(r.Action, r.Source)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrune(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	feedDir("link", 2)("data")
+	feedDir("copy", 2)("data")
+	os.Rename(filepath.Join(BaseDir, "copy", mockFileName(0)), filepath.Join(BaseDir, "copy", "copied"))
+	os.Rename(filepath.Join(BaseDir, "copy", mockFileName(1)), filepath.Join(BaseDir, "copy", "edited"))
+
+	var dots Dotfiles
+	dots.read()
+	if err := testPlan(t, dots).apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove a link and the copies from the repo, one copy being modified
+	os.Remove(filepath.Join(BaseDir, "link", mockFileName(1)))
+	os.Remove(filepath.Join(BaseDir, "copy", "copied"))
+	os.Remove(filepath.Join(BaseDir, "copy", "edited"))
+	ioutil.WriteFile(filepath.Join(RootDir, "edited"), []byte("edited"), 0666)
+
+	dots = Dotfiles{}
+	dots.read()
+	removals := dots.planPrune()
+	if len(removals) != 3 {
+		t.Fatalf("expected 3 orphans but found %v", removals)
+	}
+	prune(removals)
+
+	if _, err := os.Lstat(filepath.Join(RootDir, mockFileName(1))); !os.IsNotExist(err) {
+		t.Errorf("the orphaned link should have been removed")
+	}
+	if _, err := os.Lstat(filepath.Join(RootDir, "copied")); !os.IsNotExist(err) {
+		t.Errorf("the unchanged orphaned copy should have been removed")
+	}
+	isPresent(t, RootDir, mockFileName(0))
+	isPresent(t, RootDir, "edited")
+
+	if b, _ := cacheContains(link, filepath.Join(BaseDir, "link", mockFileName(1))); b {
+		t.Errorf("the orphaned link should have been removed from the cache")
+	}
+	if b, _ := cacheContains(copy, filepath.Join(BaseDir, "copy", "copied")); b {
+		t.Errorf("the removed copy should have been removed from the cache")
+	}
+	if b, _ := cacheContains(copy, filepath.Join(BaseDir, "copy", "edited")); !b {
+		t.Errorf("the modified orphaned copy should stay in the cache")
+	}
+
+	os.Remove(filepath.Join(RootDir, "edited"))
+	cleanup()
+	invalideCache()
+}
@@ -0,0 +1,310 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RunLog is the log of a run of apply. It is stored in its own dir of the
+// logs dir, with the output of each script in a separate file.
+type RunLog struct {
+	Time   time.Time
+	Commit string `json:",omitempty"`
+	Steps  []RunStep
+
+	Duration time.Duration
+
+	// Error is the error which stopped the run, the run was rolled back
+	Error string `json:",omitempty"`
+
+	// Dir is the directory of the run
+	Dir string `json:"-"`
+}
+
+// RunStep is a step done by a run
+type RunStep struct {
+	Op     Op
+	Source string
+	Dest   string `json:",omitempty"`
+	Reason string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+
+	// Status is the exit status of a script, and Log the file where its
+	// output is logged, relative to the run dir
+	Status   int           `json:",omitempty"`
+	Log      string        `json:",omitempty"`
+	Duration time.Duration `json:",omitempty"`
+}
+
+// MaxRunLogs is the number of runs whose log is kept
+const maxRunLogs = 50
+
+func logsDir() string {
+	return filepath.Join(StateDir, "logs")
+}
+
+// NewRunLog creates the log of a new run
+func newRunLog() (*RunLog, error) {
+	now := time.Now()
+	name := now.Format("20060102-150405")
+
+	if err := os.MkdirAll(logsDir(), 0777); err != nil {
+		return nil, fmt.Errorf("failed to create the logs dir: %v", err)
+	}
+
+	// Two runs in the same second get a suffix
+	dir := filepath.Join(logsDir(), name)
+	for i := 1; ; i++ {
+		err := os.Mkdir(dir, 0777)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create the logs dir: %v", err)
+		}
+		dir = filepath.Join(logsDir(), name+"-"+strconv.Itoa(i))
+	}
+
+	r := &RunLog{Time: now, Commit: repoCommit(), Dir: dir}
+	if err := r.save(); err != nil {
+		return nil, err
+	}
+
+	// Failing to remove the old logs doesn't prevent the run
+	trimRunLogs(maxRunLogs)
+	return r, nil
+}
+
+// TrimRunLogs removes the logs of the oldest runs to keep only the last ones
+func trimRunLogs(keep int) error {
+	runs, err := loadRunLogs()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(runs)-keep; i++ {
+		if err := os.RemoveAll(runs[i].Dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadRunLogs returns the logs of all the runs, the oldest first
+func loadRunLogs() ([]*RunLog, error) {
+	files, err := ioutil.ReadDir(logsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []*RunLog
+	for _, f := range files {
+		dir := filepath.Join(logsDir(), f.Name())
+		bytes, err := ioutil.ReadFile(filepath.Join(dir, "run.json"))
+		if err != nil {
+			// Not a run
+			continue
+		}
+
+		var r RunLog
+		if err := json.Unmarshal(bytes, &r); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal the log of %s: %v", dir, err)
+		}
+		r.Dir = dir
+		runs = append(runs, &r)
+	}
+
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Time.Before(runs[j].Time) })
+	return runs, nil
+}
+
+// Save writes the log, it is written after each step so the log of a run
+// which crashed is kept
+func (r *RunLog) save() error {
+	bytes, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(r.Dir, "run.json"), bytes)
+}
+
+// Add records a step of the run
+func (r *RunLog) add(step RunStep) error {
+	r.Steps = append(r.Steps, step)
+	return r.save()
+}
+
+// Finish records the end of the run
+func (r *RunLog) finish(err error) error {
+	r.Duration = time.Since(r.Time)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r.save()
+}
+
+// Output returns the output of the script logged by the step
+func (r *RunLog) output(step RunStep) ([]byte, error) {
+	if step.Log == "" {
+		return nil, nil
+	}
+	return ioutil.ReadFile(filepath.Join(r.Dir, step.Log))
+}
+
+// Failures returns the number of steps which failed
+func (r *RunLog) failures() int {
+	n := 0
+	for _, s := range r.Steps {
+		if s.Error != "" {
+			n++
+		}
+	}
+	return n
+}
+
+var cmdLog = &Command{
+	UsageLine: "log [-last] [-script name]",
+	Short:     "show the history of the runs",
+	Long: `
+Log lists the past runs of apply, the last one first. Each run is logged in
+the state dir with its date, the commit of the dotfiles repo, each action done
+and the output and exit status of each init script. The logs of the last 50
+runs are kept.
+
+With -last, the actions of the last run are shown with the output of its
+scripts. With -script, the runs of the given init script are shown with their
+output, only the last one if -last is given too.
+`,
+}
+
+var (
+	logLast   = cmdLog.Flag.Bool("last", false, "Show the details of the last run.")
+	logScript = cmdLog.Flag.String("script", "", "Show the runs of the given init script.")
+)
+
+func init() {
+	cmdLog.Run = runLogCommand
+}
+
+func runLogCommand(cmd *Command, args []string) int {
+	if len(args) != 0 {
+		cmd.Usage()
+		return exitUsage
+	}
+
+	if !repoExists() {
+		return exitFailure
+	}
+
+	runs, err := loadRunLogs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+		return exitFailure
+	}
+	if len(runs) == 0 {
+		fmt.Println("No run")
+		return exitOK
+	}
+
+	switch {
+	case *logScript != "":
+		found := false
+		for i := len(runs) - 1; i >= 0; i-- {
+			for _, s := range runs[i].Steps {
+				if s.Op == opRun && matchScript(s.Source, *logScript) {
+					printScriptLog(runs[i], s)
+					found = true
+				}
+			}
+			if found && *logLast {
+				break
+			}
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "dotfiles: %s has never been run\n", *logScript)
+			return exitFailure
+		}
+
+	case *logLast:
+		printRunLog(runs[len(runs)-1])
+
+	default:
+		for i := len(runs) - 1; i >= 0; i-- {
+			console.printArrow(runSummary(runs[i]))
+		}
+	}
+	return exitOK
+}
+
+// MatchScript returns true if name is the path or the name of the script,
+// with or without extension
+func matchScript(path, name string) bool {
+	base := filepath.Base(path)
+	return matchPath(path, []string{name}) || name == strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+func runSummary(r *RunLog) string {
+	line := r.Time.Format("2006-01-02 15:04:05")
+	if len(r.Commit) >= 7 {
+		line += "  " + r.Commit[:7]
+	}
+	line += fmt.Sprintf("  %d steps", len(r.Steps))
+	if n := r.failures(); n > 0 {
+		line += fmt.Sprintf(", %d failed", n)
+	}
+	if r.Error != "" {
+		line += ", rolled back: " + r.Error
+	}
+	return line
+}
+
+func printRunLog(r *RunLog) {
+	console.printHeader(runSummary(r))
+	for _, s := range r.Steps {
+		line := fmt.Sprintf("%-7s%s", s.Op, Step{Op: s.Op, Source: s.Source, Dest: s.Dest, Reason: s.Reason})
+		if s.Error != "" {
+			console.printKO(line + ": " + s.Error)
+		} else {
+			console.printOK(line)
+		}
+	}
+
+	for _, s := range r.Steps {
+		if s.Log != "" {
+			printScriptLog(r, s)
+		}
+	}
+}
+
+func printScriptLog(r *RunLog, s RunStep) {
+	header := fmt.Sprintf("%s  %s  exit status %d", filepath.Base(s.Source), r.Time.Format("2006-01-02 15:04:05"), s.Status)
+	if s.Error != "" && s.Status <= 0 {
+		header = fmt.Sprintf("%s  %s  %s", filepath.Base(s.Source), r.Time.Format("2006-01-02 15:04:05"), s.Error)
+	}
+	console.printHeader(header)
+
+	out, err := r.output(s)
+	if err != nil {
+		console.printKO(err.Error())
+		return
+	}
+	os.Stdout.Write(out)
+}
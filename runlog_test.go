@@ -0,0 +1,94 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunLog(t *testing.T) {
+	initialize()
+	invalideCache()
+	os.RemoveAll(logsDir())
+	defer os.RemoveAll(logsDir())
+
+	writeScript(t, "ok.sh", "echo done", 0666)
+	writeScript(t, "ko.sh", "echo broken; exit 3", 0666)
+
+	var dots Dotfiles
+	dots.read()
+	if err := testPlan(t, dots).apply(); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing to do, but the run is logged too
+	if err := testPlan(t, dots).apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	runs, err := loadRunLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("expected 2 runs, found %d", len(runs))
+	}
+
+	first := runs[0]
+	if first.Duration == 0 || first.Error != "" {
+		t.Errorf("the run should be finished without error, found %+v", first)
+	}
+	if first.failures() != 1 {
+		t.Errorf("expected 1 failure, found %d", first.failures())
+	}
+
+	statuses := make(map[string]int)
+	for _, s := range first.Steps {
+		if s.Op != opRun {
+			continue
+		}
+		statuses[filepath.Base(s.Source)] = s.Status
+
+		out, err := first.output(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(s.Source) == "ko.sh" && !strings.Contains(string(out), "broken") {
+			t.Errorf("the output of ko.sh should be logged, found %q", out)
+		}
+	}
+	if statuses["ok.sh"] != 0 || statuses["ko.sh"] != 3 {
+		t.Errorf("expected the exit status of the scripts, found %v", statuses)
+	}
+
+	if !matchScript(filepath.Join(BaseDir, "init", "ko.sh"), "ko") {
+		t.Error("a script should match its name without extension")
+	}
+
+	// Only the last runs are kept
+	for i := 0; i < maxRunLogs; i++ {
+		if _, err := newRunLog(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runs, err = loadRunLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != maxRunLogs {
+		t.Errorf("expected the logs of %d runs, found %d", maxRunLogs, len(runs))
+	}
+	for _, r := range runs {
+		if r.Time.Equal(first.Time) {
+			t.Error("the log of the oldest run should have been removed")
+		}
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RunLog returns the log of the run, it is created by the first step
+func (j *Journal) runLog() (*RunLog, error) {
+	if j.run != nil {
+		return j.run, nil
+	}
+
+	r, err := newRunLog()
+	if err != nil {
+		return nil, err
+	}
+	j.run = r
+	return r, nil
+}
+
+// LogStep adds the step to the log of the run
+func (j *Journal) logStep(step RunStep) error {
+	r, err := j.runLog()
+	if err != nil {
+		return err
+	}
+	return r.add(step)
+}
+
+// OpenLog creates the log file of the script in the dir of the run
+func (j *Journal) openLog(script string) (*os.File, error) {
+	r, err := j.runLog()
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(filepath.Join(r.Dir, logName(script)))
+}
+
+func logName(script string) string {
+	return filepath.Base(script) + ".log"
+}
+
+// SkipScript records that the script is skipped because a script it
+// requires didn't succeed. It counts as a failure for its own dependents.
+func (j *Journal) skipScript(s Step, req string) error {
+	msg := filepath.Base(req) + " didn't succeed"
+	console.printKO(filepath.Base(s.Source) + " skipped, " + msg)
+	j.ran[s.Source] = -1
+	return j.logStep(RunStep{Op: opSkip, Source: s.Source, Reason: s.Reason, Error: msg})
+}
+
+// ScriptDone records the result of the script started at start. An
+// interrupted script is recorded as not run, so it is proposed again by the
+// next run, and the interruption is returned to stop the run.
+func (j *Journal) scriptDone(s Step, start time.Time, err error) error {
+	step := RunStep{
+		Op:       s.Op,
+		Source:   s.Source,
+		Reason:   s.Reason,
+		Status:   exitStatus(err),
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+
+	switch err.(type) {
+	case *NotExecutableError:
+		// The script didn't run
+		return j.logStep(step)
+	case *InterruptedError:
+		step.Log = logName(s.Source)
+		if lerr := j.logStep(step); lerr != nil {
+			return lerr
+		}
+		j.ran[s.Source] = -1
+		if rerr := j.record(JournalEntry{Op: s.Op, Source: s.Source, Interrupted: true}); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+
+	step.Log = logName(s.Source)
+	if lerr := j.logStep(step); lerr != nil {
+		return lerr
+	}
+	j.ran[s.Source] = exitStatus(err)
+	cacheRun(s.Source, exitStatus(err))
+	cacheRemove(initDeselected, s.Source)
+	entry, _ := cacheGet(initRun, s.Source)
+	return j.record(JournalEntry{Op: s.Op, Source: s.Source, Run: &entry})
+}
+
+// ScriptJob is a script run in the background with its output captured
+type scriptJob struct {
+	step  Step
+	start time.Time
+	out   bytes.Buffer
+	err   error
+}
+
+// RunParallel runs the scripts with up to jobs scripts at once. A script
+// starts once the scripts it requires are done. The output of each script is
+// captured and logged, the output of the failed scripts is printed at the end.
+// Once the context is canceled, no more script is started. If a script
+// can't be recorded, the running scripts are stopped before returning.
+func (j *Journal) runParallel(ctx context.Context, steps []Step, jobs int) error {
+	var pending []Step
+	for _, s := range steps {
+		if s.Op == opRun {
+			pending = append(pending, s)
+			continue
+		}
+		if err := s.apply(ctx, j); err != nil {
+			return err
+		}
+		if err := j.logStep(RunStep{Op: s.Op, Source: s.Source, Reason: s.Reason}); err != nil {
+			return err
+		}
+	}
+	total := len(pending)
+
+	console.printHeader(fmt.Sprintf("Run %d init scripts, %d at once", total, jobs))
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	running := make(map[string]*scriptJob)
+	done := make(chan *scriptJob, total)
+	var failed []*scriptJob
+	var interrupted error
+	stop := ctx.Done()
+
+	// Abort stops the running scripts and waits for them to return err
+	abort := func(err error) error {
+		cancel(err)
+		for len(running) > 0 {
+			job := <-done
+			delete(running, job.step.Source)
+		}
+		console.clearStatus()
+		return err
+	}
+
+	for len(running) > 0 || (len(pending) > 0 && interrupted == nil) {
+		for i := 0; interrupted == nil && i < len(pending) && len(running) < jobs; {
+			s := pending[i]
+			if !readyToRun(s, pending, running) {
+				i++
+				continue
+			}
+			pending = append(pending[:i], pending[i+1:]...)
+
+			if req := j.failedRequirement(s.Requires); req != "" {
+				console.clearStatus()
+				if err := j.skipScript(s, req); err != nil {
+					return abort(err)
+				}
+				continue
+			}
+
+			logFile, err := j.openLog(s.Source)
+			if err != nil {
+				return abort(err)
+			}
+			job := &scriptJob{step: s, start: time.Now()}
+			running[s.Source] = job
+			go func() {
+				defer logFile.Close()
+				w := io.MultiWriter(&job.out, logFile)
+				job.err = runScript(ctx, job.step.Source, w, w)
+				done <- job
+			}()
+		}
+
+		if len(running) == 0 {
+			break
+		}
+		console.printStatus(runningStatus(running, total-len(pending)-len(running), total))
+
+		select {
+		case job := <-done:
+			delete(running, job.step.Source)
+			console.clearStatus()
+
+			line := fmt.Sprintf("%s (%s)", filepath.Base(job.step.Source), time.Since(job.start).Round(time.Second))
+			if job.err != nil {
+				console.printKO(line + ": " + job.err.Error())
+				failed = append(failed, job)
+			} else {
+				console.printOK(line)
+			}
+			if err := j.scriptDone(job.step, job.start, job.err); err != nil {
+				if _, ok := err.(*InterruptedError); !ok {
+					return abort(err)
+				}
+				// The other scripts are stopped by the same signal
+				interrupted = err
+			}
+
+		case <-stop:
+			// The running scripts are stopped too, wait for them
+			interrupted = context.Cause(ctx)
+			stop = nil
+		}
+	}
+	console.clearStatus()
+
+	for _, job := range failed {
+		console.printHeader("Output of " + filepath.Base(job.step.Source))
+		if !quietMode {
+			os.Stdout.Write(job.out.Bytes())
+		}
+	}
+	return interrupted
+}
+
+// ReadyToRun returns true if none of the scripts required by s is still
+// pending or running
+func readyToRun(s Step, pending []Step, running map[string]*scriptJob) bool {
+	for _, req := range s.Requires {
+		if _, ok := running[req]; ok {
+			return false
+		}
+		for _, p := range pending {
+			if p.Source == req {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func runningStatus(running map[string]*scriptJob, finished, total int) string {
+	var names []string
+	for f := range running {
+		names = append(names, filepath.Base(f))
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("[%d/%d] running %s", finished, total, strings.Join(names, ", "))
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunParallel(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	*applyJobs = 3
+	defer func() { *applyJobs = 1 }()
+
+	a := filepath.Join(RootDir, "a")
+	writeScript(t, "a.sh", "sleep 0.3; touch "+a, 0666)
+	writeScript(t, "b.sh", "# requires: a\ntest -f "+a, 0666)
+	writeScript(t, "c.sh", "sleep 0.3; echo failure; exit 2", 0666)
+	writeScript(t, "d.sh", "sleep 0.3", 0666)
+
+	var dots Dotfiles
+	dots.read()
+
+	start := time.Now()
+	if err := testPlan(t, dots).apply(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 900*time.Millisecond {
+		t.Errorf("the scripts should run in parallel, but took %s", d)
+	}
+
+	for name, status := range map[string]int{"a.sh": 0, "b.sh": 0, "c.sh": 2, "d.sh": 0} {
+		entry, ok := cacheGet(initRun, filepath.Join(BaseDir, "init", name))
+		if !ok || entry.Status != status {
+			t.Errorf("%s should have been run with the exit status %d, found %v", name, status, entry)
+		}
+	}
+
+	logs, _ := filepath.Glob(filepath.Join(StateDir, "logs", "*", "c.sh.log"))
+	if len(logs) != 1 {
+		t.Fatalf("expected the log of c.sh, found %v", logs)
+	}
+	if out, _ := ioutil.ReadFile(logs[0]); !strings.Contains(string(out), "failure") {
+		t.Errorf("the output of c.sh should be logged, found %q", out)
+	}
+
+	os.RemoveAll(filepath.Join(StateDir, "logs"))
+	cleanup()
+	invalideCache()
+}
+
+func TestScriptTimeout(t *testing.T) {
+	initialize()
+
+	path := writeScript(t, "hung.sh", "# timeout: 200ms\nsleep 10", 0666)
+
+	start := time.Now()
+	err := runScript(context.Background(), path, ioutil.Discard, ioutil.Discard)
+	if _, ok := err.(*TimeoutError); !ok {
+		t.Errorf("expected a timeout, but got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("the script should have been stopped, but took %s", d)
+	}
+
+	writeScript(t, "invalid.sh", "# timeout: soon\necho", 0666)
+	if err := runScript(context.Background(), filepath.Join(BaseDir, "init", "invalid.sh"), ioutil.Discard, ioutil.Discard); err == nil {
+		t.Errorf("expected an error for an invalid timeout")
+	}
+
+	cleanup()
+}
+
+func TestInterruptScript(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	writeScript(t, "long.sh", "sleep 10", 0666)
+	writeScript(t, "next.sh", "echo", 0666)
+
+	var dots Dotfiles
+	dots.read()
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		p, _ := os.FindProcess(os.Getpid())
+		p.Signal(os.Interrupt)
+	}()
+
+	start := time.Now()
+	err := testPlan(t, dots).apply()
+	if _, ok := err.(*InterruptedError); !ok {
+		t.Errorf("expected the plan to be interrupted, but got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("the interrupt should have been forwarded to the script, but it took %s", d)
+	}
+
+	for _, name := range []string{"long.sh", "next.sh"} {
+		if b, _ := cacheContains(initRun, filepath.Join(BaseDir, "init", name)); b {
+			t.Errorf("%s should be recorded as not run", name)
+		}
+	}
+
+	// The interruption is returned to the sequential run
+	j, err := beginJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := Step{Op: opRun, Source: filepath.Join(BaseDir, "init", "long.sh")}
+	if err := j.scriptDone(step, time.Now(), &InterruptedError{os.Interrupt}); err == nil {
+		t.Error("the interruption of the script should be returned")
+	}
+	os.RemoveAll(journalDir())
+
+	cleanup()
+	invalideCache()
+}
+
+func TestInterruptLastScript(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	feedDir("link", 1)("data")
+	writeScript(t, "last.sh", "sleep 10", 0666)
+
+	var dots Dotfiles
+	dots.read()
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		p, _ := os.FindProcess(os.Getpid())
+		p.Signal(os.Interrupt)
+	}()
+
+	err := testPlan(t, dots).apply()
+	if _, ok := err.(*InterruptedError); !ok {
+		t.Errorf("expected the plan to be interrupted, but got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(RootDir, mockFileName(0))); !os.IsNotExist(err) {
+		t.Errorf("the link should have been removed by the rollback")
+	}
+	if _, err := os.Stat(journalDir()); !os.IsNotExist(err) {
+		t.Errorf("the journal should have been removed")
+	}
+
+	cleanup()
+	invalideCache()
+}
+
+func TestRunParallelAbort(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	marker := filepath.Join(RootDir, "marker")
+	long := writeScript(t, "long.sh", "sleep 0.5; touch "+marker, 0666)
+	next := writeScript(t, "next.sh", "echo", 0666)
+
+	j, err := beginJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The log of next.sh can't be created
+	j.run = &RunLog{Dir: filepath.Join(RootDir, "logs")}
+	if err := os.MkdirAll(filepath.Join(j.run.Dir, logName(next)), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []Step{{Op: opRun, Source: long}, {Op: opRun, Source: next}}
+	if err := j.runParallel(context.Background(), steps, 2); err == nil {
+		t.Error("the run should fail when a log can't be created")
+	}
+	time.Sleep(time.Second)
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("the running scripts should have been stopped")
+	}
+
+	os.RemoveAll(j.run.Dir)
+	os.Remove(marker)
+	os.RemoveAll(journalDir())
+	cleanup()
+	invalideCache()
+}
@@ -0,0 +1,371 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Script is an init script with the directives of its header
+type Script struct {
+	Path string
+
+	// Shebang is the interpreter given by the first line of the script,
+	// eg. [/usr/bin/env python3]
+	Shebang []string
+
+	// Directives are the "# key: value" comments of the header, ie. the
+	// comments at the top of the script
+	Directives map[string]string
+}
+
+// Directive is a "# key: value" comment
+var directive = regexp.MustCompile(`^#\s*([a-z]+):\s*(.*?)\s*$`)
+
+// ParseScript reads the shebang and the header directives of the script
+func parseScript(path string) (*Script, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := &Script{Path: path, Directives: make(map[string]string)}
+
+	scanner := bufio.NewScanner(f)
+	for first := true; scanner.Scan(); first = false {
+		line := strings.TrimSpace(scanner.Text())
+
+		if first && strings.HasPrefix(line, "#!") {
+			s.Shebang = strings.Fields(strings.TrimPrefix(line, "#!"))
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			// End of the header
+			break
+		}
+
+		if m := directive.FindStringSubmatch(line); m != nil {
+			s.Directives[m[1]] = m[2]
+		}
+	}
+	return s, scanner.Err()
+}
+
+// Interpreters of the scripts without shebang, by extension. They can be
+// changed or completed by the [interpreters] table of conf/init.toml. The
+// .sh scripts are run by bash since the previous versions of dotfiles did so.
+var defaultInterpreters = map[string]string{
+	".sh":   "bash",
+	".bash": "bash",
+	".zsh":  "zsh",
+	".fish": "fish",
+	".py":   "python3",
+}
+
+// InterruptedError is returned when the run is interrupted by a signal
+type InterruptedError struct {
+	Signal os.Signal
+}
+
+func (e *InterruptedError) Error() string {
+	return "interrupted by " + e.Signal.String()
+}
+
+// TimeoutError is returned when a script runs longer than its timeout
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return "timed out after " + e.Timeout.String()
+}
+
+// Timeout returns how long the script can run: the duration given by its
+// "# timeout:" header, or the -timeout flag. 0 means no timeout.
+func (s *Script) timeout() (time.Duration, error) {
+	value, ok := s.Directives["timeout"]
+	if !ok {
+		return *applyTimeout, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid timeout %q", filepath.Base(s.Path), value)
+	}
+	return d, nil
+}
+
+// Policy returns the run policy of the script, set by its "# run:" comment
+func (s *Script) policy() (string, error) {
+	value, ok := s.Directives["run"]
+	if !ok {
+		return runOnChange, nil
+	}
+	switch value {
+	case runOnChange, runOnce, runAlways:
+		return value, nil
+	}
+	return "", fmt.Errorf("%s: unknown run policy %q", filepath.Base(s.Path), value)
+}
+
+// NotExecutableError is returned for a script which dotfiles doesn't know
+// how to run
+type NotExecutableError struct {
+	Path string
+}
+
+func (e *NotExecutableError) Error() string {
+	return filepath.Base(e.Path) + " is not executable: add a shebang, use a known extension or make it executable"
+}
+
+// Interpreters returns the interpreters by extension, the defaults
+// overridden by the config
+func interpreters() (map[string]string, error) {
+	res := make(map[string]string)
+	for ext, cmd := range defaultInterpreters {
+		res[ext] = cmd
+	}
+
+	conf, err := loadTOML(filepath.Join(BaseDir, "conf", "init.toml"))
+	if err != nil {
+		return nil, err
+	}
+
+	table, ok := conf.get("interpreters").(*tomlTable)
+	if !ok && conf.get("interpreters") != nil {
+		return nil, fmt.Errorf("conf/init.toml: interpreters should be a table")
+	}
+	if table == nil {
+		return res, nil
+	}
+	for _, ext := range table.Keys {
+		str, ok := table.get(ext).(string)
+		if !ok {
+			return nil, fmt.Errorf("conf/init.toml: the interpreter of %s should be a string", ext)
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		res[ext] = str
+	}
+	return res, nil
+}
+
+// Command returns the command line running the script: the interpreter of
+// its shebang, or the interpreter of its extension, or the script itself if
+// it is executable
+func (s *Script) command() ([]string, error) {
+	if len(s.Shebang) > 0 {
+		return append(append([]string{}, s.Shebang...), s.Path), nil
+	}
+
+	interps, err := interpreters()
+	if err != nil {
+		return nil, err
+	}
+	if interp := interps[filepath.Ext(s.Path)]; interp != "" {
+		return append(strings.Fields(interp), s.Path), nil
+	}
+
+	if fi, err := os.Stat(s.Path); err == nil && fi.Mode()&0111 != 0 {
+		return []string{s.Path}, nil
+	}
+	return nil, &NotExecutableError{s.Path}
+}
+
+// Requires returns the names of the scripts listed by the "# requires:"
+// header, separated by commas or spaces
+func (s *Script) requires() []string {
+	return splitNames(s.Directives["requires"])
+}
+
+// UnmetCondition returns the first condition of the "# when:" header which
+// doesn't hold on this machine, or "" if they all hold
+func (s *Script) unmetCondition() (string, error) {
+	return unmetCondition(s.Directives["when"])
+}
+
+// UnmetCondition returns the first of the conditions which doesn't hold on
+// this machine, eg. "os=darwin", or "" if they all hold. The conditions are
+// separated by commas or spaces, a condition can list alternatives, eg.
+// "os=linux|freebsd".
+func unmetCondition(conditions string) (string, error) {
+	for _, cond := range splitNames(conditions) {
+		i := strings.Index(cond, "=")
+		if i < 0 {
+			return "", fmt.Errorf("invalid condition %s, expected key=value", cond)
+		}
+
+		ok, err := checkCondition(cond[:i], cond[i+1:])
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return cond, nil
+		}
+	}
+	return "", nil
+}
+
+// CheckCondition returns true if one of the alternatives of the condition
+// holds:
+//
+//	os=linux       the OS, as named by Go
+//	host=build-*   the hostname matches the pattern
+//	has=apt-get    the command is in the PATH
+//	env=CI         the variable is set, env=CI=true for a given value
+func checkCondition(key, value string) (bool, error) {
+	for _, alt := range strings.Split(value, "|") {
+		switch key {
+		case "os":
+			if alt == runtime.GOOS {
+				return true, nil
+			}
+		case "host":
+			host, err := os.Hostname()
+			if err != nil {
+				return false, err
+			}
+			// The pattern can match the full name or the short one
+			for _, name := range []string{host, strings.SplitN(host, ".", 2)[0]} {
+				ok, err := path.Match(alt, name)
+				if err != nil {
+					return false, fmt.Errorf("invalid host pattern %s", alt)
+				}
+				if ok {
+					return true, nil
+				}
+			}
+		case "has":
+			if _, err := exec.LookPath(alt); err == nil {
+				return true, nil
+			}
+		case "env":
+			name, want := alt, ""
+			if i := strings.Index(alt, "="); i >= 0 {
+				name, want = alt[:i], alt[i+1:]
+			}
+			if v := os.Getenv(name); v != "" && (want == "" || v == want) {
+				return true, nil
+			}
+		default:
+			return false, fmt.Errorf("unknown condition %s", key)
+		}
+	}
+	return false, nil
+}
+
+// SortScripts orders the init scripts so that each one comes after the
+// scripts it requires, the others keeping their alphabetical order. It
+// returns the prerequisites of each script, and the reason why a script
+// can't be run: its run policy is unknown, its conditions don't hold on this
+// machine, it has no interpreter, it requires an unknown script, it is part
+// of a dependency cycle or it requires a script which can't be run.
+func sortScripts(files []string) (sorted []string, requires map[string][]string, invalid map[string]string) {
+	requires = make(map[string][]string)
+	invalid = make(map[string]string)
+
+	// A script is required by its name, with or without extension
+	byName := make(map[string]string)
+	for _, f := range files {
+		base := filepath.Base(f)
+		byName[base] = f
+		byName[strings.TrimSuffix(base, filepath.Ext(base))] = f
+	}
+
+	for _, f := range files {
+		s, err := parseScript(f)
+		if err != nil {
+			invalid[f] = err.Error()
+			continue
+		}
+		if _, err := s.policy(); err != nil {
+			invalid[f] = err.Error()
+		} else if cond, err := s.unmetCondition(); err != nil {
+			invalid[f] = err.Error()
+		} else if cond != "" {
+			invalid[f] = "only when " + cond
+		} else if _, err := s.command(); err != nil {
+			// It would fail on every run
+			invalid[f] = err.Error()
+		}
+		for _, name := range s.requires() {
+			req, ok := byName[name]
+			if !ok {
+				invalid[f] = "requires unknown script " + name
+				continue
+			}
+			requires[f] = append(requires[f], req)
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var stack []string
+
+	var visit func(f string)
+	visit = func(f string) {
+		switch state[f] {
+		case visited:
+			return
+		case visiting:
+			// The cycle is the end of the stack, from f
+			i := len(stack) - 1
+			for stack[i] != f {
+				i--
+			}
+			names := []string{}
+			for _, s := range append(stack[i:], f) {
+				names = append(names, filepath.Base(s))
+			}
+			for _, s := range stack[i:] {
+				invalid[s] = "dependency cycle " + strings.Join(names, " ➜ ")
+			}
+			return
+		}
+
+		state[f] = visiting
+		stack = append(stack, f)
+		for _, req := range requires[f] {
+			visit(req)
+		}
+		stack = stack[:len(stack)-1]
+		state[f] = visited
+		sorted = append(sorted, f)
+	}
+	for _, f := range files {
+		visit(f)
+	}
+
+	// The prerequisites come first, so the dependents of an invalid script
+	// are found in one pass
+	for _, f := range sorted {
+		for _, req := range requires[f] {
+			if _, ok := invalid[req]; ok && invalid[f] == "" {
+				invalid[f] = "requires " + filepath.Base(req) + " which can't be run"
+			}
+		}
+	}
+	return sorted, requires, invalid
+}
@@ -0,0 +1,351 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// WriteScript writes an init script and returns its path
+func writeScript(t *testing.T, name, content string, mode os.FileMode) string {
+	path := filepath.Join(BaseDir, "init", name)
+	if err := ioutil.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseScript(t *testing.T) {
+	initialize()
+
+	path := writeScript(t, "setup.py", `#!/usr/bin/env python3
+# Install the packages
+# run: once
+#requires: brew.sh
+
+import os
+# timeout: not a directive
+`, 0666)
+
+	s, err := parseScript(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Shebang, []string{"/usr/bin/env", "python3"}) {
+		t.Errorf("unexpected shebang %v", s.Shebang)
+	}
+	expected := map[string]string{"run": "once", "requires": "brew.sh"}
+	if !reflect.DeepEqual(s.Directives, expected) {
+		t.Errorf("expected the directives %v but found %v", expected, s.Directives)
+	}
+
+	cleanup()
+}
+
+func TestScriptCommand(t *testing.T) {
+	initialize()
+
+	ioutil.WriteFile(filepath.Join(BaseDir, "conf", "init.toml"), []byte(`
+[interpreters]
+".rb" = "ruby -w"
+`), 0666)
+
+	tests := []struct {
+		name    string
+		content string
+		mode    os.FileMode
+		command []string
+	}{
+		{"shebang", "#!/bin/sh -e\necho", 0666, []string{"/bin/sh", "-e"}},
+		{"setup.zsh", "echo", 0666, []string{"zsh"}},
+		{"setup.rb", "puts", 0666, []string{"ruby", "-w"}},
+		{"binary", "echo", 0777, nil},
+	}
+
+	for _, test := range tests {
+		path := writeScript(t, test.name, test.content, test.mode)
+		s, err := parseScript(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cmd, err := s.command()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		expected := append(test.command, path)
+		if !reflect.DeepEqual(cmd, expected) {
+			t.Errorf("%s: expected %v but found %v", test.name, expected, cmd)
+		}
+	}
+
+	path := writeScript(t, "notes", "echo", 0666)
+	err := runScript(context.Background(), path, os.Stdout, os.Stderr)
+	if _, ok := err.(*NotExecutableError); !ok {
+		t.Errorf("expected the script to be reported as not executable, but got %v", err)
+	}
+
+	cleanup()
+}
+
+func TestRunScript(t *testing.T) {
+	initialize()
+
+	out := filepath.Join(RootDir, "out")
+	path := writeScript(t, "posix", "#!/bin/sh\necho \"$0\" > "+out+"\n", 0666)
+	if err := runScript(context.Background(), path, os.Stdout, os.Stderr); err != nil {
+		t.Fatal(err)
+	}
+
+	bytes, err := ioutil.ReadFile(out)
+	if err != nil || strings.TrimSpace(string(bytes)) != path {
+		t.Errorf("the script should have been run with sh, but found %q (%v)", bytes, err)
+	}
+
+	cleanup()
+}
+
+func TestRunReason(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	scripts := map[string]string{
+		"new.sh":      "echo",
+		"ok.sh":       "echo",
+		"failed.sh":   "exit 1",
+		"changed.sh":  "echo",
+		"once.sh":     "# run: once\necho",
+		"always.sh":   "# run: always\necho",
+		"migrated.sh": "echo",
+		"retried.sh":  "# run: once\necho",
+		"skipped.sh":  "echo",
+		"edited.sh":   "echo",
+	}
+	for name, content := range scripts {
+		writeScript(t, name, content, 0666)
+	}
+
+	var dots Dotfiles
+	dots.read()
+	for _, f := range dots.Files[rn] {
+		switch filepath.Base(f) {
+		case "new.sh":
+		case "skipped.sh", "edited.sh":
+			// Deselected while they were new
+			step := Step{Op: opSkip, Source: f, Reason: deselected}
+			if err := step.apply(context.Background(), nil); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			cacheRun(f, exitStatus(runScript(context.Background(), f, os.Stdout, os.Stderr)))
+		}
+	}
+	cache.InitRun["init/migrated.sh"] = Entry{}
+
+	// A run once script which failed after it succeeded
+	cacheRun(filepath.Join(BaseDir, "init", "retried.sh"), 1)
+
+	writeScript(t, "changed.sh", "echo changed", 0666)
+	writeScript(t, "once.sh", "# run: once\necho changed", 0666)
+	writeScript(t, "edited.sh", "echo edited", 0666)
+
+	expected := map[string]string{
+		"new.sh":      "new",
+		"ok.sh":       "",
+		"failed.sh":   "failed",
+		"changed.sh":  "changed",
+		"once.sh":     "",
+		"always.sh":   "always",
+		"migrated.sh": "",
+		"retried.sh":  "",
+		"skipped.sh":  "",
+		"edited.sh":   "new",
+	}
+	for name, reason := range expected {
+		if r := runReason(filepath.Join(BaseDir, "init", name)); r != reason {
+			t.Errorf("%s: expected the reason %q but found %q", name, reason, r)
+		}
+	}
+
+	if entry, _ := cacheGet(initRun, filepath.Join(BaseDir, "init", "failed.sh")); entry.Status != 1 {
+		t.Errorf("expected the exit status 1 but found %d", entry.Status)
+	}
+
+	cleanup()
+	invalideCache()
+}
+
+func TestSortScripts(t *testing.T) {
+	initialize()
+
+	scripts := map[string]string{
+		"a-plugins.sh": "# requires: zsh.sh, brew\necho",
+		"brew.sh":      "echo",
+		"zsh.sh":       "# requires: brew.sh\necho",
+		"cycle1.sh":    "# requires: cycle2\necho",
+		"cycle2.sh":    "# requires: cycle1\necho",
+		"dependent.sh": "# requires: cycle1\necho",
+		"unknown.sh":   "# requires: missing\necho",
+		"policy.sh":    "# run: sometimes\necho",
+		"notes":        "echo",
+	}
+	for name, content := range scripts {
+		writeScript(t, name, content, 0666)
+	}
+
+	var dots Dotfiles
+	dots.read()
+	sorted, requires, invalid := sortScripts(dots.Files[rn])
+
+	var names []string
+	for _, f := range sorted {
+		names = append(names, filepath.Base(f))
+	}
+	expected := []string{"brew.sh", "zsh.sh", "a-plugins.sh", "cycle2.sh", "cycle1.sh", "dependent.sh", "notes", "policy.sh", "unknown.sh"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected the order %v but found %v", expected, names)
+	}
+
+	if len(requires[filepath.Join(BaseDir, "init", "a-plugins.sh")]) != 2 {
+		t.Errorf("a-plugins.sh should require 2 scripts, found %v", requires)
+	}
+
+	for _, name := range []string{"cycle1.sh", "cycle2.sh", "dependent.sh", "unknown.sh", "policy.sh", "notes"} {
+		if invalid[filepath.Join(BaseDir, "init", name)] == "" {
+			t.Errorf("%s should not be runnable", name)
+		}
+	}
+	for _, name := range []string{"brew.sh", "zsh.sh", "a-plugins.sh"} {
+		if reason := invalid[filepath.Join(BaseDir, "init", name)]; reason != "" {
+			t.Errorf("%s should be runnable, but %s", name, reason)
+		}
+	}
+
+	cleanup()
+}
+
+func TestSkipDependents(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	out := filepath.Join(RootDir, "out")
+	writeScript(t, "base.sh", "exit 1", 0666)
+	writeScript(t, "dependent.sh", "# requires: base\ntouch "+out, 0666)
+
+	var dots Dotfiles
+	dots.read()
+	plan := testPlan(t, dots)
+	if err := plan.apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("dependent.sh should have been skipped")
+	}
+	if !reflect.DeepEqual(plan.failed, []string{"base.sh", "dependent.sh"}) {
+		t.Errorf("the failed and skipped scripts should be reported, found %v", plan.failed)
+	}
+	if plan.failedScripts() == nil {
+		t.Error("the failed scripts should be an error for the callers")
+	}
+	if b, _ := cacheContains(initRun, filepath.Join(BaseDir, "init", "dependent.sh")); b {
+		t.Errorf("the skipped script should not be cached")
+	}
+
+	cleanup()
+	invalideCache()
+}
+
+func TestCheckCondition(t *testing.T) {
+	os.Setenv("DOTFILES_TEST_ENV", "yes")
+	defer os.Unsetenv("DOTFILES_TEST_ENV")
+	host, _ := os.Hostname()
+
+	tests := []struct {
+		key, value string
+		ok         bool
+	}{
+		{"os", runtime.GOOS, true},
+		{"os", "plan9|" + runtime.GOOS, true},
+		{"os", "plan9", false},
+		{"host", host, true},
+		{"host", "*", true},
+		{"host", "not-" + host, false},
+		{"has", "sh", true},
+		{"has", "no-such-command", false},
+		{"env", "DOTFILES_TEST_ENV", true},
+		{"env", "DOTFILES_TEST_ENV=yes", true},
+		{"env", "DOTFILES_TEST_ENV=no", false},
+		{"env", "DOTFILES_UNSET_ENV", false},
+	}
+	for _, test := range tests {
+		ok, err := checkCondition(test.key, test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.ok {
+			t.Errorf("%s=%s: expected %v, found %v", test.key, test.value, test.ok, ok)
+		}
+	}
+
+	if _, err := checkCondition("arch", "amd64"); err == nil {
+		t.Error("an unknown condition should be an error")
+	}
+}
+
+func TestConditionalScripts(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	out := filepath.Join(RootDir, "out")
+	writeScript(t, "desktop.sh", "# when: os="+runtime.GOOS+", has=no-such-command\ntouch "+out, 0666)
+	writeScript(t, "theme.sh", "# requires: desktop\ntouch "+out, 0666)
+	writeScript(t, "server.sh", "# when: os="+runtime.GOOS+"\ntrue", 0666)
+
+	var dots Dotfiles
+	dots.read()
+
+	reasons := make(map[string]string)
+	for _, step := range testInitSteps(t, dots) {
+		if step.Op == opSkip {
+			reasons[filepath.Base(step.Source)] = step.Reason
+		}
+	}
+	expected := map[string]string{
+		"desktop.sh": "only when has=no-such-command",
+		"theme.sh":   "requires desktop.sh which can't be run",
+	}
+	if !reflect.DeepEqual(reasons, expected) {
+		t.Errorf("expected the skipped scripts %v, found %v", expected, reasons)
+	}
+
+	// -run-init doesn't override the conditions
+	*initRunNames = "desktop"
+	defer func() { *initRunNames = "" }()
+	if err := testPlan(t, dots).apply(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Error("the scripts whose conditions don't hold should not run")
+	}
+	if b, _ := cacheContains(initRun, filepath.Join(BaseDir, "init", "desktop.sh")); b {
+		t.Error("the scripts whose conditions don't hold should not be cached")
+	}
+
+	cleanup()
+	invalideCache()
+}
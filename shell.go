@@ -0,0 +1,235 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ShellExtensions lists the extensions of the files of the source dir
+// sourced by each shell. The .sh files are POSIX and sourced by all the
+// shells but fish.
+var shellExtensions = map[string][]string{
+	"sh":   {".sh"},
+	"bash": {".sh", ".bash"},
+	"zsh":  {".sh", ".zsh"},
+	"fish": {".fish"},
+}
+
+var cmdShellInit = &Command{
+	UsageLine: "shell-init [-compile] bash|zsh|fish|sh",
+	Short:     "print the loader of the source dir for a shell",
+	Long: `
+Shell-init prints the commands sourcing the files of the source dir in the
+given shell, after the shell config of conf/shell.toml. Add this line to the
+.zshrc, or its equivalent for the other shells:
+
+    eval "$(dotfiles shell-init zsh)"
+
+For fish, add this line to config.fish:
+
+    dotfiles shell-init fish | source
+
+The aliases, the environment variables and the PATH entries declared in
+conf/shell.toml are written for the shell before the files are sourced:
+
+    [env]
+    EDITOR = "nvim"
+    GOPATH = "~/go"
+
+    [aliases]
+    ll = "ls -l"
+
+    [path]
+    prepend = ["~/bin", "$GOPATH/bin"]
+    append = ["/usr/local/go/bin"]
+
+    [[match]]
+    when = "os=darwin, has=brew"
+    aliases = { ls = "ls -G" }
+    path.prepend = ["/opt/homebrew/bin"]
+
+The values are quoted for the shell, except for the references to variables,
+$NAME or ${NAME}, and a leading ~. The variables are exported in the order
+they are declared, so a variable can refer to the ones before it. A directory
+is only added to the PATH if it is not there yet. A [[match]] section only
+applies where its conditions hold, they are the conditions of the init
+scripts (see 'dotfiles help apply').
+
+The files are sourced in the alphabetical order of their path in the source
+dir, so they can be ordered by a prefix, eg. 10-path.sh and 20-aliases.zsh.
+Each shell only sources the files with its extensions:
+
+    sh      .sh
+    bash    .sh .bash
+    zsh     .sh .zsh
+    fish    .fish
+
+With -compile, the loader is written in the state dir and its path is
+printed. Sourcing this file directly is faster than running dotfiles at each
+shell startup:
+
+    . ~/.local/state/dotfiles/dotfiles-3f2a9c01/shell/init.zsh
+
+The compiled loader sources the files of the source dir where they are, so
+the changes of their content are seen at once. The commands changing the
+dotfiles, eg. apply or add, update the compiled loaders for the files added
+to or removed from the source dir and for the changes of conf/shell.toml. The
+conditions of conf/shell.toml are then checked when the loader is compiled
+rather than at each shell startup.
+`,
+}
+
+var shellCompile = cmdShellInit.Flag.Bool("compile", false, "Write the loader in the state dir and print its path.")
+
+func init() {
+	cmdShellInit.Run = runShellInit
+}
+
+func runShellInit(cmd *Command, args []string) int {
+	if len(args) != 1 || shellExtensions[args[0]] == nil {
+		cmd.Usage()
+		return exitUsage
+	}
+	shell := args[0]
+
+	if !repoExists() {
+		return exitFailure
+	}
+
+	if *shellCompile {
+		// The loaders are also written by the commands changing the repo
+		if err := lock(*lockWait); err != nil {
+			fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+			return exitFailure
+		}
+		err := compileLoader(shell)
+		unlock()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+			return exitFailure
+		}
+		fmt.Println(compiledLoaderPath(shell))
+		return exitOK
+	}
+
+	loader, err := shellLoader(shell)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+		return exitFailure
+	}
+	fmt.Printf("# Generated by dotfiles shell-init %s\n%s", shell, loader)
+	return exitOK
+}
+
+// SourceFiles returns the files of the source dir sourced by the shell, in
+// the alphabetical order of their path
+func sourceFiles(shell string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(filepath.Join(BaseDir, "source"), func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		for _, ext := range shellExtensions[shell] {
+			if filepath.Ext(path) == ext {
+				files = append(files, path)
+			}
+		}
+		return nil
+	})
+
+	// Walk already orders the files of each dir, sort them as a whole
+	sort.Strings(files)
+	return files, err
+}
+
+// ShellLoader returns the commands sourcing the files of the source dir
+func shellLoader(shell string) (string, error) {
+	files, err := sourceFiles(shell)
+	if err != nil {
+		return "", err
+	}
+
+	conf, err := loadShellConf()
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	b.WriteString(conf.snippet(shell))
+	for _, f := range files {
+		if shell == "fish" {
+			fmt.Fprintf(&b, "source %s\n", quoteShell(shell, f))
+		} else {
+			fmt.Fprintf(&b, ". %s\n", quoteShell(shell, f))
+		}
+	}
+	return b.String(), nil
+}
+
+// CompiledLoaderPath returns the path of the compiled loader of the shell
+func compiledLoaderPath(shell string) string {
+	return filepath.Join(StateDir, "shell", "init."+shell)
+}
+
+// CompileLoader writes the loader of the shell in the state dir. The file is
+// left alone if it is up to date.
+func compileLoader(shell string) error {
+	loader, err := shellLoader(shell)
+	if err != nil {
+		return err
+	}
+	content := []byte(fmt.Sprintf("# Generated by dotfiles shell-init -compile %s, don't edit it\n%s", shell, loader))
+
+	path := compiledLoaderPath(shell)
+	if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, content) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return fmt.Errorf("failed to create the shell dir: %v", err)
+	}
+	return writeFileAtomic(path, content)
+}
+
+// UpdateCompiledLoaders compiles again the loaders compiled before, so they
+// follow the files added to the source dir and the changes of
+// conf/shell.toml
+func updateCompiledLoaders() error {
+	for shell := range shellExtensions {
+		if _, err := os.Stat(compiledLoaderPath(shell)); err != nil {
+			continue
+		}
+		if err := compileLoader(shell); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QuoteShell quotes the string as a single word for the shell
+func quoteShell(shell, s string) string {
+	if shell == "fish" {
+		// In fish, \ and ' are escaped in single quotes
+		s = strings.Replace(s, `\`, `\\`, -1)
+		return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
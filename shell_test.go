@@ -0,0 +1,127 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeSource(t *testing.T, name, content string) string {
+	path := filepath.Join(BaseDir, "source", name)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSourceFiles(t *testing.T) {
+	initialize()
+
+	writeSource(t, "20-aliases.zsh", "")
+	writeSource(t, "10-path.sh", "")
+	writeSource(t, "30-prompt.fish", "")
+	writeSource(t, "15-bash/completion.bash", "")
+	writeSource(t, "README", "")
+
+	expected := map[string][]string{
+		"sh":   {"10-path.sh"},
+		"bash": {"10-path.sh", "15-bash/completion.bash"},
+		"zsh":  {"10-path.sh", "20-aliases.zsh"},
+		"fish": {"30-prompt.fish"},
+	}
+	for shell, names := range expected {
+		files, err := sourceFiles(shell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rels []string
+		for _, f := range files {
+			rel, _ := filepath.Rel(filepath.Join(BaseDir, "source"), f)
+			rels = append(rels, rel)
+		}
+		if !reflect.DeepEqual(rels, names) {
+			t.Errorf("%s: expected %v, found %v", shell, names, rels)
+		}
+	}
+
+	cleanup()
+}
+
+func TestShellLoader(t *testing.T) {
+	initialize()
+
+	out := filepath.Join(RootDir, "out")
+	writeSource(t, "10-first.sh", "echo first >> '"+out+"'")
+	writeSource(t, "20-it's.sh", "echo second >> '"+out+"'")
+
+	loader, err := shellLoader("sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("sh", "-c", loader).Run(); err != nil {
+		t.Fatalf("failed to run the loader %q: %v", loader, err)
+	}
+	if content, _ := ioutil.ReadFile(out); string(content) != "first\nsecond\n" {
+		t.Errorf("the files should be sourced in order, found %q", content)
+	}
+
+	// The compiled loader sources the files where they are, so they can
+	// use $0 or return
+	writeSource(t, "15-return.sh", "return 0\necho never >> '"+out+"'")
+	if err := compileLoader("sh"); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(out)
+	if err := exec.Command("sh", "-c", ". '"+compiledLoaderPath("sh")+"'").Run(); err != nil {
+		t.Fatalf("failed to source the compiled loader: %v", err)
+	}
+	if content, _ := ioutil.ReadFile(out); string(content) != "first\nsecond\n" {
+		t.Errorf("the compiled loader should source the files in order, found %q", content)
+	}
+
+	// The compiled loaders only are updated
+	writeSource(t, "30-third.sh", "echo third")
+	if err := updateCompiledLoaders(); err != nil {
+		t.Fatal(err)
+	}
+	compiled, _ := ioutil.ReadFile(compiledLoaderPath("sh"))
+	if !strings.Contains(string(compiled), "30-third.sh") {
+		t.Errorf("the compiled loader should have been updated, found %q", compiled)
+	}
+	if _, err := os.Stat(compiledLoaderPath("zsh")); !os.IsNotExist(err) {
+		t.Error("only the compiled loaders should be updated")
+	}
+
+	os.RemoveAll(filepath.Dir(compiledLoaderPath("sh")))
+	cleanup()
+}
+
+func TestQuoteShell(t *testing.T) {
+	tests := []struct {
+		shell, s, expected string
+	}{
+		{"sh", "it's", `'it'\''s'`},
+		{"zsh", "$HOME", `'$HOME'`},
+		{"fish", `it's a \ `, `'it\'s a \\ '`},
+	}
+	for _, test := range tests {
+		if quoted := quoteShell(test.shell, test.s); quoted != test.expected {
+			t.Errorf("%s: expected %s, found %s", test.shell, test.expected, quoted)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ShellConf is the shell config declared in conf/shell.toml, eg.
+//
+//	[env]
+//	EDITOR = "nvim"
+//	GOPATH = "~/go"
+//
+//	[aliases]
+//	ll = "ls -l"
+//
+//	[path]
+//	prepend = ["~/bin", "$GOPATH/bin"]
+//	append = ["/usr/local/go/bin"]
+//
+//	[[match]]
+//	when = "os=darwin, has=brew"
+//	aliases = { ls = "ls -G" }
+//	path.prepend = ["/opt/homebrew/bin"]
+//
+// The [[match]] sections only apply on the machines where their conditions
+// hold, they are written after the main section in their order.
+type ShellConf struct {
+	Env     [][2]string
+	Aliases [][2]string
+	Prepend []string
+	Append  []string
+}
+
+var (
+	envName   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	aliasName = regexp.MustCompile(`^[A-Za-z0-9_.:+-]+$`)
+
+	// VarRef is a reference to a variable in a value, $NAME or ${NAME}
+	varRef = regexp.MustCompile(`\$([A-Za-z_][A-Za-z0-9_]*|\{[A-Za-z_][A-Za-z0-9_]*\})`)
+)
+
+func shellConfPath() string {
+	return filepath.Join(BaseDir, "conf", "shell.toml")
+}
+
+// LoadShellConf reads conf/shell.toml, keeping the sections whose conditions
+// hold on this machine
+func loadShellConf() (*ShellConf, error) {
+	table, err := loadTOML(shellConfPath())
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ShellConf{}
+	if err := c.add(table, true); err != nil {
+		return nil, fmt.Errorf("conf/shell.toml: %v", err)
+	}
+
+	matches, ok := table.get("match").([]interface{})
+	if !ok && table.get("match") != nil {
+		return nil, fmt.Errorf("conf/shell.toml: match should be an array of tables, ie. [[match]]")
+	}
+	for i, m := range matches {
+		section, ok := m.(*tomlTable)
+		if !ok {
+			return nil, fmt.Errorf("conf/shell.toml: match should be an array of tables, ie. [[match]]")
+		}
+
+		when, ok := section.get("when").(string)
+		if !ok {
+			return nil, fmt.Errorf("conf/shell.toml: the match section %d should have a when string", i+1)
+		}
+		cond, err := unmetCondition(when)
+		if err != nil {
+			return nil, fmt.Errorf("conf/shell.toml: %v", err)
+		}
+		if cond != "" {
+			continue
+		}
+
+		if err := c.add(section, false); err != nil {
+			return nil, fmt.Errorf("conf/shell.toml: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// Add adds the env, aliases and path of the section. The keys of a table
+// are added in the order of their declaration, so a variable can refer to
+// the ones declared before.
+func (c *ShellConf) add(section *tomlTable, top bool) error {
+	for _, key := range section.Keys {
+		value := section.get(key)
+		switch key {
+		case "env", "aliases":
+			table, ok := value.(*tomlTable)
+			if !ok {
+				return fmt.Errorf("%s should be a table", key)
+			}
+			for _, name := range table.Keys {
+				str, ok := table.get(name).(string)
+				if !ok {
+					return fmt.Errorf("%s.%s should be a string", key, name)
+				}
+				if key == "env" {
+					if !envName.MatchString(name) {
+						return fmt.Errorf("invalid variable name %q", name)
+					}
+					c.Env = append(c.Env, [2]string{name, str})
+				} else {
+					if !aliasName.MatchString(name) {
+						return fmt.Errorf("invalid alias name %q", name)
+					}
+					c.Aliases = append(c.Aliases, [2]string{name, str})
+				}
+			}
+
+		case "path":
+			table, ok := value.(*tomlTable)
+			if !ok {
+				return fmt.Errorf("path should be a table")
+			}
+			for _, k := range table.Keys {
+				dirs, ok := table.get(k).([]interface{})
+				if !ok {
+					return fmt.Errorf("path.%s should be an array of strings", k)
+				}
+				for _, d := range dirs {
+					dir, ok := d.(string)
+					if !ok {
+						return fmt.Errorf("path.%s should be an array of strings", k)
+					}
+					switch k {
+					case "prepend":
+						c.Prepend = append(c.Prepend, dir)
+					case "append":
+						c.Append = append(c.Append, dir)
+					default:
+						return fmt.Errorf("unknown key path.%s, expected prepend or append", k)
+					}
+				}
+			}
+
+		case "match":
+			if !top {
+				return fmt.Errorf("a match section can't contain another one")
+			}
+		case "when":
+			if top {
+				return fmt.Errorf("when is only allowed in a match section")
+			}
+		default:
+			return fmt.Errorf("unknown key %s", key)
+		}
+	}
+	return nil
+}
+
+// PathEntries returns the dirs to prepend and to append to the PATH without
+// duplicates, a dir both prepended and appended is only prepended
+func (c *ShellConf) pathEntries() (prepend, appendDirs []string) {
+	seen := make(map[string]bool)
+	for _, dir := range c.Prepend {
+		if !seen[dir] {
+			seen[dir] = true
+			prepend = append(prepend, dir)
+		}
+	}
+	for _, dir := range c.Append {
+		if !seen[dir] {
+			seen[dir] = true
+			appendDirs = append(appendDirs, dir)
+		}
+	}
+	return prepend, appendDirs
+}
+
+// Snippet returns the commands declaring the config in the shell. The PATH
+// entries are only added if they are not in the PATH yet, so the snippet can
+// be sourced by nested shells.
+func (c *ShellConf) snippet(shell string) string {
+	if len(c.Env) == 0 && len(c.Aliases) == 0 && len(c.Prepend) == 0 && len(c.Append) == 0 {
+		return ""
+	}
+
+	var b bytes.Buffer
+	b.WriteString("# Generated from conf/shell.toml\n")
+
+	for _, env := range c.Env {
+		if shell == "fish" {
+			fmt.Fprintf(&b, "set -gx %s %s\n", env[0], shellWord(shell, env[1]))
+		} else {
+			fmt.Fprintf(&b, "export %s=%s\n", env[0], shellWord(shell, env[1]))
+		}
+	}
+
+	prepend, appendDirs := c.pathEntries()
+	// The first dir to prepend ends up first in the PATH
+	for i := len(prepend) - 1; i >= 0; i-- {
+		dir := shellWord(shell, prepend[i])
+		if shell == "fish" {
+			fmt.Fprintf(&b, "contains -- %s $PATH; or set -gx PATH %s $PATH\n", dir, dir)
+		} else {
+			fmt.Fprintf(&b, "case \":${PATH}:\" in *:%s:*) ;; *) PATH=%s\"${PATH:+:${PATH}}\" ;; esac\n", dir, dir)
+		}
+	}
+	for _, dir := range appendDirs {
+		dir := shellWord(shell, dir)
+		if shell == "fish" {
+			fmt.Fprintf(&b, "contains -- %s $PATH; or set -gx PATH $PATH %s\n", dir, dir)
+		} else {
+			fmt.Fprintf(&b, "case \":${PATH}:\" in *:%s:*) ;; *) PATH=\"${PATH:+${PATH}:}\"%s ;; esac\n", dir, dir)
+		}
+	}
+	if shell != "fish" && len(prepend)+len(appendDirs) > 0 {
+		b.WriteString("export PATH\n")
+	}
+
+	for _, alias := range c.Aliases {
+		if shell == "fish" {
+			fmt.Fprintf(&b, "alias %s %s\n", alias[0], quoteShell(shell, alias[1]))
+		} else {
+			fmt.Fprintf(&b, "alias %s=%s\n", alias[0], quoteShell(shell, alias[1]))
+		}
+	}
+	return b.String()
+}
+
+// ShellWord quotes the value as a single word for the shell, except its
+// references to variables, $NAME or ${NAME}, and a leading ~ which are
+// expanded by the shell
+func shellWord(shell, value string) string {
+	if value == "~" || strings.HasPrefix(value, "~/") {
+		value = "$HOME" + value[1:]
+	}
+
+	var b bytes.Buffer
+	last := 0
+	for _, loc := range varRef.FindAllStringIndex(value, -1) {
+		if loc[0] > last {
+			b.WriteString(quoteShell(shell, value[last:loc[0]]))
+		}
+		name := strings.Trim(value[loc[0]+1:loc[1]], "{}")
+		if shell == "fish" {
+			b.WriteString(`"$` + name + `"`)
+		} else {
+			b.WriteString(`"${` + name + `}"`)
+		}
+		last = loc[1]
+	}
+	if last < len(value) || last == 0 {
+		b.WriteString(quoteShell(shell, value[last:]))
+	}
+	return b.String()
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func writeShellConf(t *testing.T, content string) {
+	if err := ioutil.WriteFile(shellConfPath(), []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadShellConf(t *testing.T) {
+	initialize()
+
+	writeShellConf(t, `
+[env]
+GOPATH = "~/go"
+GOBIN = "$GOPATH/bin"
+EDITOR = "nvim"
+
+[aliases]
+ll = "ls -l"
+
+[path]
+prepend = ["~/bin", "$GOPATH/bin", "~/bin"]
+append = ["/opt/bin", "~/bin"]
+
+[[match]]
+when = "os=`+runtime.GOOS+`"
+aliases = { ls = "ls --color" }
+
+[[match]]
+when = "has=no-such-command"
+env = { NEVER = "set" }
+`)
+
+	conf, err := loadShellConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &ShellConf{
+		Env:     [][2]string{{"GOPATH", "~/go"}, {"GOBIN", "$GOPATH/bin"}, {"EDITOR", "nvim"}},
+		Aliases: [][2]string{{"ll", "ls -l"}, {"ls", "ls --color"}},
+		Prepend: []string{"~/bin", "$GOPATH/bin", "~/bin"},
+		Append:  []string{"/opt/bin", "~/bin"},
+	}
+	if !reflect.DeepEqual(conf, expected) {
+		t.Errorf("expected %v, found %v", expected, conf)
+	}
+
+	prepend, appendDirs := conf.pathEntries()
+	if !reflect.DeepEqual(prepend, []string{"~/bin", "$GOPATH/bin"}) || !reflect.DeepEqual(appendDirs, []string{"/opt/bin"}) {
+		t.Errorf("the PATH entries should be de-duplicated, found %v and %v", prepend, appendDirs)
+	}
+
+	for _, invalid := range []string{
+		"[env]\n\"NOT VALID\" = \"x\"",
+		"[aliases]\nll = 1",
+		"[path]\nfirst = [\"/bin\"]",
+		"[[match]]\naliases = { ll = \"ls\" }",
+		"[[match]]\nwhen = \"arch=arm\"",
+		"when = \"os=linux\"",
+		"[prompt]",
+	} {
+		writeShellConf(t, invalid)
+		if _, err := loadShellConf(); err == nil {
+			t.Errorf("%q should be rejected", invalid)
+		}
+	}
+
+	cleanup()
+}
+
+func TestShellSnippet(t *testing.T) {
+	conf := &ShellConf{
+		Env:     [][2]string{{"GREETING", "it's \"$USER\" `id`"}, {"DOTS", "~/dots"}},
+		Aliases: [][2]string{{"hi", "echo 'hi'"}},
+		Prepend: []string{"/first", "/second"},
+		Append:  []string{"/last", "/usr/bin"},
+	}
+
+	for _, shell := range []string{"sh", "bash"} {
+		script := "PATH=/usr/bin:/bin\n" + conf.snippet(shell) + `
+# Sourced twice, as by a nested shell
+` + conf.snippet(shell) + `
+echo "$GREETING"
+echo "$DOTS"
+echo "$PATH"
+alias hi`
+		out, err := exec.Command(shell, "-c", script).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v\n%s\n%s", shell, err, script, out)
+		}
+
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		expected := []string{
+			"it's \"" + os.Getenv("USER") + "\" `id`",
+			os.Getenv("HOME") + "/dots",
+			"/first:/second:/usr/bin:/bin:/last",
+		}
+		if len(lines) < 4 || !reflect.DeepEqual(lines[:3], expected) {
+			t.Errorf("%s: expected %q, found %q", shell, expected, lines)
+		}
+		if len(lines) < 4 || !strings.Contains(lines[3], "hi=") {
+			t.Errorf("%s: the alias should be defined, found %q", shell, lines)
+		}
+	}
+
+	fish := conf.snippet("fish")
+	for _, line := range []string{
+		`set -gx GREETING 'it\'s "'"$USER"'" ` + "`id`'",
+		`set -gx DOTS "$HOME"'/dots'`,
+		`contains -- '/first' $PATH; or set -gx PATH '/first' $PATH`,
+		`contains -- '/last' $PATH; or set -gx PATH $PATH '/last'`,
+		`alias hi 'echo \'hi\''`,
+	} {
+		if !strings.Contains(fish, line+"\n") {
+			t.Errorf("fish: expected %s in\n%s", line, fish)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// StateDir is the directory where the machine-local state of the dotfiles
+// repo is kept: the cache, the journal and the backups. It is outside of
+// the repo so it is never committed.
+var StateDir = defaultStateDir()
+
+// DefaultStateDir returns $DOTFILES_STATE_DIR if it is set, otherwise
+// $XDG_STATE_HOME/dotfiles/<repo-id>, $XDG_STATE_HOME defaulting to
+// ~/.local/state
+func defaultStateDir() string {
+	if dir := os.Getenv("DOTFILES_STATE_DIR"); dir != "" {
+		return dir
+	}
+
+	home := os.Getenv("XDG_STATE_HOME")
+	if home == "" {
+		home = filepath.Join(RootDir, ".local", "state")
+	}
+	return filepath.Join(home, "dotfiles", repoID())
+}
+
+// RepoID identifies the dotfiles repo on this machine, eg. dotfiles-3f2a9c01
+func repoID() string {
+	abs, err := filepath.Abs(BaseDir)
+	if err != nil {
+		abs = BaseDir
+	}
+	sum := sha256.Sum256([]byte(abs))
+	name := strings.TrimPrefix(filepath.Base(abs), ".")
+	return name + "-" + hex.EncodeToString(sum[:4])
+}
+
+// WriteFileAtomic writes the data to a temporary file synced on disk, then
+// renames it to path so a crash never leaves a partial file
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	// Sync the dir so the rename itself is durable
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// LegacyStateDirs are the dirs of the repo where the previous versions of
+// dotfiles kept their state
+var legacyStateDirs = []string{"cache", "backup"}
+
+// LegacyCachePath returns where the previous versions of dotfiles kept the
+// cache
+func legacyCachePath() string {
+	return filepath.Join(BaseDir, "cache", "cache.json")
+}
+
+// LegacyBackupDir returns where the previous versions of dotfiles kept the
+// backups
+func legacyBackupDir() string {
+	return filepath.Join(BaseDir, "backup")
+}
+
+// MigrateState moves the state left in the repo by the previous versions of
+// dotfiles into the state dir. The files already in the state dir are kept.
+// It must only be called with the lock held, the read-only commands read the
+// legacy state where it is instead.
+func migrateState() error {
+	moves := map[string]string{
+		legacyCachePath():                          cachePath,
+		filepath.Join(BaseDir, "cache", "journal"): journalDir(),
+	}
+
+	backups, err := ioutil.ReadDir(legacyBackupDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range backups {
+		moves[filepath.Join(legacyBackupDir(), f.Name())] = filepath.Join(backupDir(), f.Name())
+	}
+
+	for from, to := range moves {
+		if _, err := os.Lstat(from); err != nil {
+			continue
+		}
+		if _, err := os.Lstat(to); err == nil {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(to), 0777); err != nil {
+			return fmt.Errorf("failed to create the state dir: %v", err)
+		}
+		if err := exec.Command("mv", from, to).Run(); err != nil {
+			return fmt.Errorf("failed to move %s to %s: %v", from, to, err)
+		}
+	}
+
+	// Remove the legacy dirs once they are empty
+	for _, dir := range legacyStateDirs {
+		os.Remove(filepath.Join(BaseDir, dir))
+	}
+	return nil
+}
+
+// WriteGitignore ignores the legacy state dirs in the repo, in case an older
+// version of dotfiles is run on another machine
+func writeGitignore() error {
+	path := filepath.Join(BaseDir, ".gitignore")
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	content := "# Machine-local state of the previous versions of dotfiles\n"
+	for _, dir := range legacyStateDirs {
+		content += "/" + dir + "/\n"
+	}
+	return ioutil.WriteFile(path, []byte(content), 0666)
+}
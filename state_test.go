@@ -0,0 +1,73 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateState(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	if !strings.HasPrefix(StateDir, os.Getenv("XDG_STATE_HOME")) {
+		t.Fatalf("the state dir %s should be in $XDG_STATE_HOME", StateDir)
+	}
+	isPresent(t, BaseDir, ".gitignore")
+
+	// State left in the repo by a previous version
+	linked := filepath.Join(BaseDir, "link", mockFileName(0))
+	legacy := `{"Version":2,"Link":{"` + linked + `":{}}}`
+	os.MkdirAll(filepath.Join(BaseDir, "cache"), 0777)
+	ioutil.WriteFile(filepath.Join(BaseDir, "cache", "cache.json"), []byte(legacy), 0666)
+	os.MkdirAll(filepath.Join(BaseDir, "backup"), 0777)
+	ioutil.WriteFile(filepath.Join(BaseDir, "backup", ".zshrc"), []byte("data"), 0666)
+
+	// A read-only command reads the legacy state where it is
+	cache = Cache{}
+	loadCache()
+	if b, _ := cacheContains(link, linked); !b {
+		t.Errorf("the legacy cache should contains %s", linked)
+	}
+	if gens, _ := loadGenerations(); len(gens) != 1 || len(gens[0].Entries) != 1 {
+		t.Errorf("the legacy backup should be listed, found %v", gens)
+	}
+	isPresent(t, BaseDir, filepath.Join("cache", "cache.json"))
+
+	// The state is only migrated with the lock held
+	if err := lock(0); err != nil {
+		t.Fatal(err)
+	}
+
+	cache = Cache{}
+	loadCache()
+
+	if b, _ := cacheContains(link, linked); !b {
+		t.Errorf("the migrated cache should contains %s", linked)
+	}
+	if _, ok := cache.Link[filepath.Join("link", mockFileName(0))]; !ok {
+		t.Errorf("the cache should be keyed by repo-relative paths, but found %v", cache.Link)
+	}
+	isPresent(t, StateDir, "cache.json")
+	isPresent(t, backupDir(), ".zshrc")
+
+	for _, dir := range legacyStateDirs {
+		if _, err := os.Stat(filepath.Join(BaseDir, dir)); !os.IsNotExist(err) {
+			t.Errorf("the legacy %s dir should have been removed", dir)
+		}
+	}
+
+	unlock()
+	cleanup()
+	invalideCache()
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var cmdStatus = &Command{
+	Run:       runStatus,
+	UsageLine: "status",
+	Short:     "show the drift between the home directory and the dotfiles repo",
+	Long: `
+Status compares each file of the link and copy dirs with its counterpart in the
+home directory, without changing anything. Each file is reported as:
+
+    in sync     the file is linked or copied and up to date
+    missing     the file is not in the home directory
+    modified    the copy in the home directory has been modified
+    outdated    the file changed in the repo since it was copied
+    replaced    the link has been replaced by a file or points somewhere else
+    untracked   the file has been applied but is no longer in the repo
+
+Status exits with 3 if any file is not in sync.
+`,
+}
+
+// State is the state of a dotfile in the home directory
+type State int
+
+const (
+	inSync State = iota
+	missing
+	modified
+	outdated
+	replaced
+	untracked
+)
+
+func (s State) String() string {
+	var str string
+	switch s {
+	case inSync:
+		str = "in sync"
+	case missing:
+		str = "missing"
+	case modified:
+		str = "modified"
+	case outdated:
+		str = "outdated"
+	case replaced:
+		str = "replaced"
+	case untracked:
+		str = "untracked"
+	}
+	return str
+}
+
+// FileStatus is the state of a dotfile compared to its target
+type FileStatus struct {
+	Dir    Dir
+	Source string
+	Target string
+	State  State
+}
+
+func runStatus(cmd *Command, args []string) int {
+	if len(args) != 0 {
+		cmd.Usage()
+		return exitUsage
+	}
+
+	if !repoExists() {
+		return exitFailure
+	}
+	loadCache()
+
+	var dots Dotfiles
+	dots.read()
+
+	code := exitOK
+	for _, st := range dots.status() {
+		rel, err := filepath.Rel(RootDir, st.Target)
+		if err != nil {
+			rel = st.Target
+		}
+
+		line := fmt.Sprintf("%-10s %s", st.State, rel)
+		if st.State == inSync {
+			console.printOK(line)
+		} else {
+			console.printKO(line)
+			code = exitDrift
+		}
+	}
+	return code
+}
+
+// Status returns the state of all the linked and copied files, followed by
+// the cached files which are no longer in the repo
+func (dots Dotfiles) status() []FileStatus {
+	var res []FileStatus
+
+	for _, dir := range [2]Dir{ln, cp} {
+		for _, f := range dots.Files[dir] {
+			res = append(res, FileStatus{dir, f, target(f), fileState(dir, f)})
+		}
+
+		files := make(map[string]bool)
+		for _, f := range dots.Files[dir] {
+			files[f] = true
+		}
+		for _, f := range cacheFiles(dir.action()) {
+			if !files[f] {
+				res = append(res, FileStatus{dir, f, target(f), untracked})
+			}
+		}
+	}
+	return res
+}
+
+// FileState returns the state of the target of a linked or copied file
+func fileState(dir Dir, file string) State {
+	fi, err := os.Lstat(target(file))
+	if err != nil {
+		return missing
+	}
+
+	isLink := fi.Mode()&os.ModeSymlink != 0
+
+	if dir == ln {
+		if !isLink {
+			return replaced
+		}
+		dest, err := os.Readlink(target(file))
+		if err != nil || filepath.Clean(dest) != filepath.Clean(file) {
+			return replaced
+		}
+		return inSync
+	}
+
+	if isLink {
+		return replaced
+	}
+	if !backgroundCheck(file) {
+		return inSync
+	}
+	if entry, ok := cacheGet(copy, file); ok && entry.DestHash != "" && copyUnchanged(file) {
+		return outdated
+	}
+	return modified
+}
+
+// CopyUnchanged returns true if the copy of the file didn't change since it
+// has been applied. If its hash is not known, the copy is compared with the
+// source, it can't be checked once the source is removed.
+func copyUnchanged(file string) bool {
+	entry, ok := cacheGet(copy, file)
+	if !ok || entry.DestHash == "" {
+		if _, err := os.Stat(file); err != nil {
+			return false
+		}
+		return !backgroundCheck(file)
+	}
+	return hashFile(target(file)) == entry.DestHash
+}
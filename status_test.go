@@ -0,0 +1,68 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	initialize()
+
+	for _, name := range []string{"copy/modified", "copy/missing", "copy/sync", "link/replaced", "link/linked"} {
+		err := ioutil.WriteFile(filepath.Join(BaseDir, name), []byte("data"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var dots Dotfiles
+	dots.read()
+	if err := testPlan(t, dots).apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := ioutil.WriteFile(filepath.Join(RootDir, "modified"), []byte("local data"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(RootDir, "missing"))
+	os.Remove(filepath.Join(RootDir, "replaced"))
+	err = ioutil.WriteFile(filepath.Join(RootDir, "replaced"), []byte("data"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cacheAdd(link, filepath.Join(BaseDir, "link", "removed"))
+
+	expected := map[string]State{
+		filepath.Join(BaseDir, "copy", "modified"): modified,
+		filepath.Join(BaseDir, "copy", "missing"):  missing,
+		filepath.Join(BaseDir, "copy", "sync"):     inSync,
+		filepath.Join(BaseDir, "link", "replaced"): replaced,
+		filepath.Join(BaseDir, "link", "linked"):   inSync,
+		filepath.Join(BaseDir, "link", "removed"):  untracked,
+	}
+
+	statuses := dots.status()
+	if len(statuses) != len(expected) {
+		t.Errorf("expected %d statuses but found %d", len(expected), len(statuses))
+	}
+	for _, st := range statuses {
+		if st.State != expected[st.Source] {
+			t.Errorf("%s should be %s but was %s", st.Source, expected[st.Source], st.State)
+		}
+	}
+
+	cleanup()
+	invalideCache()
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// IsTerminal returns true if the file is a console
+func isTerminal(f *os.File) bool {
+	var mode uint32
+	return syscall.GetConsoleMode(syscall.Handle(f.Fd()), &mode) == nil
+}
+
+// MakeRaw is not supported, the text prompt is used instead of the menu
+func makeRaw(f *os.File) (func(), error) {
+	return nil, errors.New("raw mode is not supported")
+}
+
+func terminalSize(f *os.File) (width, height int, err error) {
+	return 0, 0, errors.New("terminal size is not supported")
+}
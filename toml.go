@@ -0,0 +1,541 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The config files of the conf dir are written in TOML. Since dotfiles has
+// no dependency, only the subset of TOML they need is parsed:
+//
+//	- tables, arrays of tables and inline tables
+//	- bare, quoted and dotted keys
+//	- basic strings with the escapes of TOML, and literal strings
+//	- integers, in decimal or with a 0x, 0o or 0b prefix
+//	- booleans and arrays
+//
+// The multi-line strings, the floats and the dates are rejected with an
+// error rather than misread. The tables are decoded to a *tomlTable and the
+// arrays to []interface{}.
+
+// TomlTable is a TOML table, its keys are kept in the order of their
+// declaration
+type tomlTable struct {
+	Keys   []string
+	Values map[string]interface{}
+
+	// defined is true once the table has been declared by a [table] header
+	// or written inline, it can't be declared again
+	defined bool
+}
+
+func newTOMLTable() *tomlTable {
+	return &tomlTable{Values: make(map[string]interface{})}
+}
+
+// Get returns the value of the key, or nil
+func (t *tomlTable) get(key string) interface{} {
+	return t.Values[key]
+}
+
+func (t *tomlTable) set(key string, value interface{}) {
+	if _, ok := t.Values[key]; !ok {
+		t.Keys = append(t.Keys, key)
+	}
+	t.Values[key] = value
+}
+
+// LoadTOML parses the TOML file at path, it returns an empty table if the
+// file doesn't exist
+func loadTOML(path string) (*tomlTable, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return newTOMLTable(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := parseTOML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return table, nil
+}
+
+type tomlParser struct {
+	data string
+	pos  int
+	line int
+}
+
+// ParseTOML parses the TOML document
+func parseTOML(data string) (*tomlTable, error) {
+	p := &tomlParser{data: data, line: 1}
+	root := newTOMLTable()
+	current := root
+
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return root, nil
+		}
+
+		if p.peek() == '[' {
+			array := strings.HasPrefix(p.data[p.pos:], "[[")
+			if array {
+				p.pos += 2
+			} else {
+				p.pos++
+			}
+
+			p.skipSpace()
+			keys, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+
+			if array {
+				if !strings.HasPrefix(p.data[p.pos:], "]]") {
+					return nil, p.errorf("expected ]]")
+				}
+				p.pos += 2
+				current, err = p.appendTable(root, keys)
+			} else {
+				if p.eof() || p.peek() != ']' {
+					return nil, p.errorf("expected ]")
+				}
+				p.pos++
+				current, err = p.defineTable(root, keys)
+			}
+			if err != nil {
+				return nil, p.errorf("%v", err)
+			}
+		} else {
+			keys, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			if p.eof() || p.peek() != '=' {
+				return nil, p.errorf("expected = after %s", strings.Join(keys, "."))
+			}
+			p.pos++
+			p.skipSpace()
+
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.setKey(current, keys, value); err != nil {
+				return nil, p.errorf("%v", err)
+			}
+		}
+
+		// Only a comment can follow on the same line
+		p.skipSpace()
+		p.skipComment()
+		if !p.eof() && p.peek() != '\n' && p.peek() != '\r' {
+			return nil, p.errorf("unexpected %q", p.peek())
+		}
+	}
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *tomlParser) peek() byte {
+	return p.data[p.pos]
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+// SkipSpace skips the spaces and tabs
+func (p *tomlParser) skipSpace() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+func (p *tomlParser) skipComment() {
+	if !p.eof() && p.peek() == '#' {
+		for !p.eof() && p.peek() != '\n' {
+			p.pos++
+		}
+	}
+}
+
+// SkipBlank skips the spaces, the comments and the new lines
+func (p *tomlParser) skipBlank() {
+	for {
+		p.skipSpace()
+		p.skipComment()
+		if p.eof() {
+			return
+		}
+		switch p.peek() {
+		case '\n':
+			p.line++
+		case '\r':
+		default:
+			return
+		}
+		p.pos++
+	}
+}
+
+// ParseKey parses a bare, quoted or dotted key
+func (p *tomlParser) parseKey() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return nil, p.errorf("expected a key")
+		}
+
+		switch c := p.peek(); {
+		case c == '"' || c == '\'':
+			key, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case isBareKeyChar(c):
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			keys = append(keys, p.data[start:p.pos])
+		default:
+			return nil, p.errorf("unexpected %q in a key", c)
+		}
+
+		p.skipSpace()
+		if p.eof() || p.peek() != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *tomlParser) parseValue() (interface{}, error) {
+	if p.eof() {
+		return nil, p.errorf("expected a value")
+	}
+
+	switch p.peek() {
+	case '"', '\'':
+		if strings.HasPrefix(p.data[p.pos:], `"""`) || strings.HasPrefix(p.data[p.pos:], "'''") {
+			return nil, p.errorf("multi-line strings are not supported")
+		}
+		return p.parseString()
+	case '[':
+		return p.parseArray()
+	case '{':
+		return p.parseInlineTable()
+	}
+
+	start := p.pos
+	for !p.eof() && strings.IndexByte(" \t\r\n,]}#", p.peek()) == -1 {
+		p.pos++
+	}
+	word := p.data[start:p.pos]
+
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if n, ok := parseInteger(word); ok {
+		return n, nil
+	}
+	switch {
+	case strings.HasPrefix(word, "0x"):
+	case strings.Contains(word, ":") || strings.LastIndex(word, "-") > 0:
+		return nil, p.errorf("dates are not supported: %s", word)
+	case strings.ContainsAny(word, ".eE") || strings.Trim(word, "+-") == "inf" || strings.Trim(word, "+-") == "nan":
+		return nil, p.errorf("floats are not supported: %s", word)
+	}
+	return nil, p.errorf("invalid value %q", word)
+}
+
+// ParseInteger parses a TOML integer: decimal without leading zeros, or
+// hexadecimal, octal or binary with a 0x, 0o or 0b prefix. An underscore is
+// only allowed between two digits.
+func parseInteger(word string) (int64, bool) {
+	digits, base := strings.TrimLeft(word, "+-"), 10
+	if len(word) > 2 && word[0] == '0' && strings.IndexByte("xob", word[1]) >= 0 {
+		digits, base = word[2:], map[byte]int{'x': 16, 'o': 8, 'b': 2}[word[1]]
+		word = digits
+	} else if len(digits) > 1 && digits[0] == '0' {
+		return 0, false
+	}
+
+	if digits == "" || strings.IndexByte("_+-", digits[0]) >= 0 || digits[len(digits)-1] == '_' || strings.Contains(digits, "__") {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(strings.Replace(word, "_", "", -1), base, 64)
+	return n, err == nil
+}
+
+// ParseString parses a basic "string" with escapes or a literal 'string'
+func (p *tomlParser) parseString() (string, error) {
+	quote := p.peek()
+	start := p.pos
+	p.pos++
+
+	for !p.eof() && p.peek() != quote && p.peek() != '\n' {
+		if quote == '"' && p.peek() == '\\' {
+			p.pos++
+		}
+		p.pos++
+	}
+	if p.eof() || p.peek() != quote {
+		return "", p.errorf("unterminated string")
+	}
+	p.pos++
+
+	raw := p.data[start+1 : p.pos-1]
+	for _, c := range raw {
+		if c < 0x20 && c != '\t' || c == 0x7f {
+			return "", p.errorf("control character %q in a string", c)
+		}
+	}
+	if quote == '\'' {
+		return raw, nil
+	}
+	s, err := unescape(raw)
+	if err != nil {
+		return "", p.errorf("invalid string %s: %v", p.data[start:p.pos], err)
+	}
+	return s, nil
+}
+
+// Unescape replaces the escape sequences of a TOML basic string
+func unescape(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("trailing \\")
+		}
+		switch c := s[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'f':
+			b.WriteByte('\f')
+		case 'r':
+			b.WriteByte('\r')
+		case '"':
+			b.WriteByte('"')
+		case '\\':
+			b.WriteByte('\\')
+		case 'u', 'U':
+			n := 4
+			if c == 'U' {
+				n = 8
+			}
+			if i+n >= len(s) {
+				return "", fmt.Errorf("invalid escape \\%s", s[i:])
+			}
+			code, err := strconv.ParseUint(s[i+1:i+1+n], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(code)) {
+				return "", fmt.Errorf("invalid escape \\%s", s[i:i+1+n])
+			}
+			b.WriteRune(rune(code))
+			i += n
+		default:
+			return "", fmt.Errorf("invalid escape \\%c", c)
+		}
+	}
+	return b.String(), nil
+}
+
+// ParseArray parses an array, which can span several lines
+func (p *tomlParser) parseArray() ([]interface{}, error) {
+	p.pos++
+	array := []interface{}{}
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return nil, p.errorf("unterminated array")
+		}
+		if p.peek() == ']' {
+			p.pos++
+			return array, nil
+		}
+
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+
+		p.skipBlank()
+		if !p.eof() && p.peek() == ',' {
+			p.pos++
+		} else if p.eof() || p.peek() != ']' {
+			return nil, p.errorf("expected , or ] in an array")
+		}
+	}
+}
+
+// ParseInlineTable parses a table written on one line, eg. { os = "linux" }
+func (p *tomlParser) parseInlineTable() (*tomlTable, error) {
+	p.pos++
+	table := newTOMLTable()
+	table.defined = true
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return nil, p.errorf("unterminated inline table")
+		}
+		if p.peek() == '}' {
+			p.pos++
+			return table, nil
+		}
+
+		keys, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.eof() || p.peek() != '=' {
+			return nil, p.errorf("expected = after %s", strings.Join(keys, "."))
+		}
+		p.pos++
+		p.skipSpace()
+
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.setKey(table, keys, value); err != nil {
+			return nil, p.errorf("%v", err)
+		}
+
+		p.skipSpace()
+		if !p.eof() && p.peek() == ',' {
+			p.pos++
+		} else if p.eof() || p.peek() != '}' {
+			return nil, p.errorf("expected , or } in an inline table")
+		}
+	}
+}
+
+// SubTable returns the table at the dotted keys, creating the missing ones.
+// For an array of tables, the last table is used.
+func (p *tomlParser) subTable(table *tomlTable, keys []string) (*tomlTable, error) {
+	for _, key := range keys {
+		switch v := table.get(key).(type) {
+		case nil:
+			sub := newTOMLTable()
+			table.set(key, sub)
+			table = sub
+		case *tomlTable:
+			table = v
+		case []interface{}:
+			if len(v) == 0 {
+				return nil, fmt.Errorf("%s is not a table", key)
+			}
+			last, ok := v[len(v)-1].(*tomlTable)
+			if !ok {
+				return nil, fmt.Errorf("%s is not a table", key)
+			}
+			table = last
+		default:
+			return nil, fmt.Errorf("%s is not a table", key)
+		}
+	}
+	return table, nil
+}
+
+// DefineTable returns the table declared by a [table] header. A table can be
+// created implicitly by the header of a sub-table before being declared, but
+// it can't be declared twice.
+func (p *tomlParser) defineTable(root *tomlTable, keys []string) (*tomlTable, error) {
+	table, err := p.subTable(root, keys)
+	if err != nil {
+		return nil, err
+	}
+	if _, array := p.lookup(root, keys).([]interface{}); array || table.defined {
+		return nil, fmt.Errorf("table %s is defined twice", strings.Join(keys, "."))
+	}
+	table.defined = true
+	return table, nil
+}
+
+// Lookup returns the value at the dotted keys, the tables on the way must
+// exist
+func (p *tomlParser) lookup(root *tomlTable, keys []string) interface{} {
+	parent, err := p.subTable(root, keys[:len(keys)-1])
+	if err != nil {
+		return nil
+	}
+	return parent.get(keys[len(keys)-1])
+}
+
+// AppendTable adds a new table to the array of tables at the dotted keys
+func (p *tomlParser) appendTable(root *tomlTable, keys []string) (*tomlTable, error) {
+	parent, err := p.subTable(root, keys[:len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	key := keys[len(keys)-1]
+	table := newTOMLTable()
+	table.defined = true
+	switch v := parent.get(key).(type) {
+	case nil:
+		parent.set(key, []interface{}{table})
+	case []interface{}:
+		parent.set(key, append(v, table))
+	default:
+		return nil, fmt.Errorf("%s is not an array of tables", key)
+	}
+	return table, nil
+}
+
+func (p *tomlParser) setKey(table *tomlTable, keys []string, value interface{}) error {
+	table, err := p.subTable(table, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+
+	key := keys[len(keys)-1]
+	if table.get(key) != nil {
+		return fmt.Errorf("%s is defined twice", strings.Join(keys, "."))
+	}
+	table.set(key, value)
+	return nil
+}
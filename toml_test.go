@@ -0,0 +1,150 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	doc := `
+# comment
+title = "dot\tfiles" # trailing comment
+count = 1_000
+mask = 0o755
+negative = -12
+escapes = "\b\f\r\n\"\\\u00e9\U0001F600"
+enabled = true
+
+[interpreters]
+".py" = 'python3 -u'
+sh = "bash"
+
+[env.paths]
+list = [
+  "a",   # first
+  'b',
+]
+
+[[alias]]
+name = "ll"
+when = { os = "linux", has = ["ls"] }
+
+[[alias]]
+name = "la"
+`
+
+	table, err := parseTOML(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"title":    "dot\tfiles",
+		"count":    int64(1000),
+		"mask":     int64(0755),
+		"negative": int64(-12),
+		"escapes":  "\b\f\r\n\"\\\u00e9\U0001F600",
+		"enabled":  true,
+		"interpreters": map[string]interface{}{
+			".py": "python3 -u",
+			"sh":  "bash",
+		},
+		"env": map[string]interface{}{
+			"paths": map[string]interface{}{
+				"list": []interface{}{"a", "b"},
+			},
+		},
+		"alias": []interface{}{
+			map[string]interface{}{
+				"name": "ll",
+				"when": map[string]interface{}{
+					"os":  "linux",
+					"has": []interface{}{"ls"},
+				},
+			},
+			map[string]interface{}{"name": "la"},
+		},
+	}
+	if found := plainTOML(table); !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected\n%v\nbut found\n%v", expected, found)
+	}
+
+	keys := []string{"title", "count", "mask", "negative", "escapes", "enabled", "interpreters", "env", "alias"}
+	if !reflect.DeepEqual(table.Keys, keys) {
+		t.Errorf("expected the keys in the order %v, found %v", keys, table.Keys)
+	}
+	when := table.get("alias").([]interface{})[0].(*tomlTable).get("when").(*tomlTable)
+	if !reflect.DeepEqual(when.Keys, []string{"os", "has"}) {
+		t.Errorf("expected the keys of the inline table in order, found %v", when.Keys)
+	}
+
+	// A table can be declared after its sub-tables
+	if _, err := parseTOML("[a.b]\nc = 1\n[a]\nd = 2"); err != nil {
+		t.Errorf("a table declared after its sub-table should be accepted: %v", err)
+	}
+}
+
+// PlainTOML converts the tables of a TOML value to maps
+func plainTOML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *tomlTable:
+		m := make(map[string]interface{})
+		for _, key := range v.Keys {
+			m[key] = plainTOML(v.get(key))
+		}
+		return m
+	case []interface{}:
+		var array []interface{}
+		for _, e := range v {
+			array = append(array, plainTOML(e))
+		}
+		return array
+	}
+	return value
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	docs := []string{
+		`key = `,
+		`key = "unterminated`,
+		`key = 1 2`,
+		"key = 1\nkey = 2",
+		`[table`,
+		`list = [1, 2`,
+		`key = value`,
+		`key = 012`,
+		`key = 0x-1`,
+		`key = 1__000`,
+		`key = 3.14`,
+		`key = 1e6`,
+		`key = inf`,
+		`key = 1979-05-27`,
+		`key = 07:32:00`,
+		`key = """multi-line"""`,
+		`key = "\x41"`,
+		`key = "\'"`,
+		`key = "\u00"`,
+		`key = "\uD800"`,
+		"key = \"tab\x01\"",
+		"a = []\n[a.b]",
+		"a = []\na.b = 1",
+		"[a]\nb = 1\n[a]\nc = 2",
+		"[a.b]\n[a.b]",
+		"a = { b = 1 }\n[a]",
+		"[[a]]\n[a]",
+	}
+
+	for _, doc := range docs {
+		if _, err := parseTOML(doc); err == nil {
+			t.Errorf("expected an error for %q", doc)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var cmdUninstall = &Command{
+	UsageLine: "uninstall [-yes] [-dry-run]",
+	Short:     "remove the links and copies made by dotfiles",
+	Long: `
+Uninstall undoes what dotfiles did in the home directory. It removes the links
+which still point into the dotfiles repo and the copies which didn't change
+since they were applied, then puts back the original files from the backups.
+The dirs created by dotfiles to hold the files are removed once empty.
+
+The files which have been modified or replaced are left alone, uninstall
+reports them with the reason. So are the copies made before dotfiles recorded
+their hash whose source has been removed, since they can't be checked. The
+init scripts can't be undone.
+
+The removal is confirmed first. Like the global flag, -yes answers yes; with
+-non-interactive or without terminal, nothing is removed.
+`,
+	Lock: true,
+}
+
+var uninstallDryRun = cmdUninstall.Flag.Bool("dry-run", false, "Print what would be done without doing it.")
+
+func init() {
+	cmdUninstall.Run = runUninstall
+	cmdUninstall.Flag.BoolVar(assumeYes, "yes", false, "Don't ask for confirmation, same as the global -yes.")
+}
+
+// Removal is a file applied by dotfiles that uninstall removes or leaves alone
+type Removal struct {
+	Action Action
+	Source string
+	Target string
+
+	// Reason explains why the file is left alone, it is empty if the file
+	// is removed
+	Reason string
+
+	// Restored is true once the original file has been put back
+	Restored bool
+}
+
+func runUninstall(cmd *Command, args []string) int {
+	if len(args) != 0 {
+		cmd.Usage()
+		return exitUsage
+	}
+
+	if !repoExists() {
+		return exitFailure
+	}
+	loadCache()
+
+	removals := planUninstall()
+
+	count := 0
+	for _, r := range removals {
+		if r.Reason == "" {
+			count++
+		}
+	}
+
+	if *uninstallDryRun {
+		printRemovals(removals)
+		return exitOK
+	}
+
+	if count > 0 && !console.confirm(fmt.Sprintf("Remove %d files from %s?", count, RootDir)) {
+		return exitFailure
+	}
+
+	code := exitOK
+	if err := uninstall(removals); err != nil {
+		fmt.Fprintf(os.Stderr, "dotfiles: %v\n", err)
+		code = exitFailure
+	}
+
+	printRemovals(removals)
+	return code
+}
+
+// PlanUninstall checks each cached link and copy to know if it can be removed
+func planUninstall() []Removal {
+	var removals []Removal
+
+	for _, f := range cacheFiles(link) {
+		removals = append(removals, linkRemoval(f))
+	}
+	for _, f := range cacheFiles(copy) {
+		removals = append(removals, copyRemoval(f))
+	}
+	return removals
+}
+
+// LinkRemoval checks if the link to the given file can be removed
+func linkRemoval(f string) Removal {
+	r := Removal{Action: link, Source: f, Target: target(f)}
+
+	fi, err := os.Lstat(r.Target)
+	switch {
+	case err != nil:
+		r.Reason = "already removed"
+	case fi.Mode()&os.ModeSymlink == 0:
+		r.Reason = "replaced by a file"
+	default:
+		dest, err := os.Readlink(r.Target)
+		if err != nil || !strings.HasPrefix(filepath.Clean(dest), BaseDir+string(filepath.Separator)) {
+			r.Reason = "points to " + dest
+		}
+	}
+	return r
+}
+
+// CopyRemoval checks if the copy of the given file can be removed
+func copyRemoval(f string) Removal {
+	r := Removal{Action: copy, Source: f, Target: target(f)}
+
+	entry, _ := cacheGet(copy, f)
+	_, serr := os.Stat(f)
+
+	fi, err := os.Lstat(r.Target)
+	switch {
+	case err != nil:
+		r.Reason = "already removed"
+	case !fi.Mode().IsRegular():
+		r.Reason = "replaced by a link or a directory"
+	case entry.DestHash == "" && serr != nil:
+		r.Reason = "the source has been removed, the copy can't be checked"
+	case !copyUnchanged(f):
+		r.Reason = "modified since it was copied"
+	}
+	return r
+}
+
+// Uninstall removes the files, restores their backups and forgets them
+func uninstall(removals []Removal) error {
+	gens, err := loadGenerations()
+	if err != nil {
+		return err
+	}
+
+	var res restorer
+	for i := range removals {
+		r := &removals[i]
+
+		// Stop managing the file even if it is left alone
+		if err := cacheRemove(r.Action, r.Source); err != nil {
+			return err
+		}
+		if r.Reason != "" {
+			continue
+		}
+
+		if err := os.Remove(r.Target); err != nil {
+			r.Reason = err.Error()
+			continue
+		}
+
+		// Put back the last backup of the file
+	restore:
+		for g := len(gens) - 1; g >= 0; g-- {
+			for e, entry := range gens[g].Entries {
+				if entry.Path == r.Target && entry.Restored.IsZero() {
+					if err := res.restore(gens[g], e); err != nil {
+						return err
+					}
+					r.Restored = true
+					break restore
+				}
+			}
+		}
+
+		removeCreatedDirs(filepath.Dir(r.Target))
+	}
+	return nil
+}
+
+// RemoveCreatedDirs removes dir and its parents as long as they are empty
+// and have been created by dotfiles
+func removeCreatedDirs(dir string) {
+	for {
+		if ok, _ := cacheContains(createdDir, dir); !ok {
+			return
+		}
+		if err := os.Remove(dir); err != nil {
+			// The dir isn't empty, it is removed with its last file
+			return
+		}
+		cacheRemove(createdDir, dir)
+		dir = filepath.Dir(dir)
+	}
+}
+
+func printRemovals(removals []Removal) {
+	console.printHeader("Removed")
+	for _, r := range removals {
+		if r.Reason == "" {
+			if r.Restored {
+				console.printOK(shortPath(r.Target) + " (original restored)")
+			} else {
+				console.printOK(shortPath(r.Target))
+			}
+		}
+	}
+
+	console.printHeader("Left alone")
+	for _, r := range removals {
+		if r.Reason != "" {
+			console.printKO(shortPath(r.Target) + ": " + r.Reason)
+		}
+	}
+}
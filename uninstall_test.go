@@ -0,0 +1,83 @@
+// Copyright (c) 2015 by Pierre Thirouin. All rights reserved.
+
+// This file is part of dotfiles, a simple dotfiles manager.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUninstall(t *testing.T) {
+	initialize()
+	invalideCache()
+
+	for _, name := range []string{"copy/copied", "copy/modified", "copy/orphan", "copy/.app/conf/nested", "link/linked", "link/replaced"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(BaseDir, name)), 0777)
+		err := ioutil.WriteFile(filepath.Join(BaseDir, name), []byte("data"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// This one will be backed up then restored
+	err := ioutil.WriteFile(filepath.Join(RootDir, "linked"), []byte("original"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dots Dotfiles
+	dots.read()
+	if err := testPlan(t, dots).apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(filepath.Join(RootDir, "modified"), []byte("local data"), 0666)
+	os.Remove(filepath.Join(RootDir, "replaced"))
+	ioutil.WriteFile(filepath.Join(RootDir, "replaced"), []byte("local data"), 0666)
+
+	// The hash of the copy is unknown and its source is gone, it can't be
+	// checked
+	orphan := filepath.Join(BaseDir, "copy", "orphan")
+	cache.Copy[cacheKey(orphan)] = Entry{}
+	os.Remove(orphan)
+
+	removals := planUninstall()
+	if err := uninstall(removals); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{"copied": true, "modified": false, "orphan": false, "nested": true, "linked": true, "replaced": false}
+	for _, r := range removals {
+		if (r.Reason == "") != expected[filepath.Base(r.Target)] {
+			t.Errorf("unexpected removal of %s: %q", r.Target, r.Reason)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(RootDir, "copied")); !os.IsNotExist(err) {
+		t.Errorf("the copy should have been removed")
+	}
+	if _, err := os.Stat(filepath.Join(RootDir, ".app")); !os.IsNotExist(err) {
+		t.Errorf("the dirs created for the copy should have been removed")
+	}
+	for name, content := range map[string]string{"linked": "original", "modified": "local data", "orphan": "data", "replaced": "local data"} {
+		bytes, err := ioutil.ReadFile(filepath.Join(RootDir, name))
+		if err != nil || string(bytes) != content {
+			t.Errorf("expected %q in %s but found %q (%v)", content, name, bytes, err)
+		}
+	}
+
+	if len(cache.Link) != 0 || len(cache.Copy) != 0 || len(cache.CreatedDir) != 0 {
+		t.Errorf("the cache should be empty but found %v", cache)
+	}
+
+	cleanup()
+	invalideCache()
+}